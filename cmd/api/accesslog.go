@@ -0,0 +1,75 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Logs one entry per req. Success responses are sampled with
+// -access-log-sample-rate, everything else is always logged.
+func (app *application) accessLog(next http.Handler) http.Handler {
+	if !app.config.accessLog.enabled {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		next.ServeHTTP(w, r)
+
+		info := app.contextGetRequestInfo(r)
+		status := info.status()
+
+		cfg := app.liveConfig()
+
+		if cfg.accessLog.excludeHealth && isHealthProbe(r) {
+			return
+		}
+
+		if status < 300 && rand.Float64() >= cfg.accessLog.sampleRate {
+			return
+		}
+
+		properties := map[string]any{
+			"method":     r.Method,
+			"route":      info.route,
+			"status":     status,
+			"bytes":      info.response.bytesWritten,
+			"duration":   time.Since(start),
+			"client_ip":  app.contextGetClientIP(r),
+			"user_agent": r.UserAgent(),
+		}
+
+		// Unmatched reqs have no route, the path is the next best thing.
+		if info.route == "" {
+			properties["path"] = r.URL.Path
+		}
+
+		if info.userID != 0 {
+			properties["user_id"] = info.userID
+		}
+
+		app.loggerFor(r.Context()).PrintInfo("request", properties)
+	})
+}
+
+func isHealthProbe(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/v1/healthz/") || r.URL.Path == "/v1/healthcheck"
+}
+
+// Records the route pattern and user for outer middleware, see requestInfo.
+func (app *application) matchedRoute(pattern string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if info := app.contextGetRequestInfo(r); info != nil {
+			info.route = pattern
+
+			if user := app.contextGetUser(r); !user.IsAnonymous() {
+				info.userID = user.ID
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
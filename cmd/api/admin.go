@@ -0,0 +1,101 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// Internals for operators: expvar, pprof, Prometheus metrics, build info,
+// readiness details, crash reports and the live config. Served on its own
+// listener (-admin-addr or -admin-unix-socket) that should never be reachable
+// from outside the box, so there's no auth on any of it.
+func (app *application) adminRoutes() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle("/metrics", app.registry.Handler())
+	mux.HandleFunc("/debug/build", app.buildInfoHandler)
+	mux.HandleFunc("/debug/config", app.configHandler)
+	mux.HandleFunc("/debug/health", app.healthDetailHandler)
+	mux.HandleFunc("/debug/crashes", app.listCrashReportsHandler)
+	mux.HandleFunc("/debug/crashes/", app.showCrashReportHandler)
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return app.recoverPanic(mux)
+}
+
+// Server for adminRoutes, nil if the admin listener is off.
+func (app *application) adminServer() (*http.Server, net.Listener, error) {
+	var ln net.Listener
+	var err error
+
+	switch {
+	case app.config.admin.unixSocket != "":
+		// Only our own user gets in.
+		ln, err = listenUnix(app.config.admin.unixSocket, 0o600)
+	case app.config.admin.addr != "":
+		ln, err = net.Listen("tcp", app.config.admin.addr)
+	default:
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	srv := &http.Server{
+		Handler:           app.adminRoutes(),
+		ErrorLog:          log.New(app.logger, "", 0),
+		IdleTimeout:       time.Minute,
+		ReadHeaderTimeout: 10 * time.Second,
+		// No WriteTimeout, CPU profiles and traces take as long as asked.
+	}
+
+	return srv, ln, nil
+}
+
+func (app *application) buildInfoHandler(w http.ResponseWriter, r *http.Request) {
+	build := map[string]any{
+		"version":    version,
+		"go_version": runtime.Version(),
+		"os":         runtime.GOOS,
+		"arch":       runtime.GOARCH,
+	}
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		settings := make(map[string]string, len(info.Settings))
+		for _, s := range info.Settings {
+			settings[s.Key] = s.Value
+		}
+
+		deps := make(map[string]string, len(info.Deps))
+		for _, dep := range info.Deps {
+			deps[dep.Path] = dep.Version
+		}
+
+		build["module"] = info.Main.Path
+		build["settings"] = settings
+		build["dependencies"] = deps
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"build": build}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Like `api config print`, but with any SIGHUP reloads applied.
+func (app *application) configHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	printConfig(w, &app.config, app.flags, reloadableSettings(app.liveConfig()))
+}
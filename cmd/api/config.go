@@ -0,0 +1,660 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"greenlight/internal/clientip"
+	"greenlight/internal/jsonlog"
+	"greenlight/internal/ratelimit"
+	"greenlight/internal/toml"
+	"greenlight/internal/validator"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Struct to hold all config settings for the app.
+//
+// Settings are layered, each one overriding the last:
+//  1. defaults (below)
+//  2. the TOML file from -config / GREENLIGHT_CONFIG
+//  3. GREENLIGHT_* env vars, e.g. GREENLIGHT_DB_MAX_OPEN_CONNS
+//  4. cmd flags, e.g. -db-max-open-conns
+//
+// The file uses the flag names split into tables, so -db-max-open-conns is
+// max_open_conns under [db].
+type config struct {
+	port       int
+	unixSocket struct {
+		path string
+		mode fileMode
+	}
+	admin struct {
+		addr       string
+		unixSocket string
+	}
+	env           string
+	logLevel      levelFlag
+	logStackLevel levelFlag
+	logRedactKeys spaceList
+	shutdownDelay time.Duration
+	db            struct {
+		dsn               string
+		maxOpenConns      int
+		maxIdleConns      int
+		maxIdleTime       time.Duration
+		maxLifetime       time.Duration
+		connectRetries    int
+		connectBackoff    time.Duration
+		connectMaxBackoff time.Duration
+		replicaDSN        string
+		replicaStickiness time.Duration
+	}
+	limiter struct {
+		rps     float64
+		burst   int
+		ipRPS   float64
+		ipBurst int
+		enabled bool
+		backend string
+		tiers   tierList
+		routes  routeLimits
+	}
+	smtp struct {
+		host     string
+		port     int
+		username string
+		password string
+		sender   string
+	}
+	cors struct {
+		trustedOrigins []string
+	}
+	trustedProxies []string
+	proxyHeader    string
+	clientIPs      *clientip.Resolver // Built from the two above by validate().
+	accessLog      struct {
+		enabled       bool
+		sampleRate    float64
+		excludeHealth bool
+	}
+	tracing struct {
+		exporter   string
+		endpoint   string
+		file       string
+		sampleRate float64
+	}
+	shed struct {
+		maxInFlight      int
+		maxInFlightRead  int
+		maxInFlightWrite int
+		priorityReserve  int
+		maxQueue         int
+		maxPriorityQueue int
+		queueTimeout     time.Duration
+	}
+	tls struct {
+		cert       string
+		key        string
+		minVersion string
+		clientCA   string
+		// Who may log in with a client cert, everyone else gets a 401.
+		clientAccounts []string
+	}
+	password struct {
+		memory       uint
+		iterations   uint
+		parallelism  uint
+		memoryBudget uint
+		breachedFile string
+		minScore     int
+	}
+
+	// Not settings as such, just how we were started.
+	args           []string
+	file           string
+	displayVersion bool
+}
+
+// Flags holding secrets. Each also gets a -<name>-file variant which reads the
+// value from a file instead, for Docker/systemd style secrets. Never printed.
+var secretFlags = []string{"db-dsn", "db-replica-dsn", "smtp-username", "smtp-password"}
+
+// Flags holding a list. Flags and env vars give it space separated, a TOML
+// array item by item so items can have spaces in them.
+type listValue interface {
+	flag.Value
+	SetList(items []string) error
+}
+
+// Space separated list flag.
+type spaceList []string
+
+func (l *spaceList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *spaceList) Set(s string) error {
+	return l.SetList(strings.Fields(s))
+}
+
+func (l *spaceList) SetList(items []string) error {
+	*l = items
+	return nil
+}
+
+// Log level flag, e.g. info.
+type levelFlag jsonlog.Level
+
+func (l *levelFlag) String() string {
+	// Off isn't a level entries are logged at, so it has no name of its own.
+	if jsonlog.Level(*l) == jsonlog.LevelOff {
+		return "off"
+	}
+
+	return strings.ToLower(jsonlog.Level(*l).String())
+}
+
+func (l *levelFlag) Set(s string) error {
+	level, err := jsonlog.ParseLevel(s)
+	if err != nil {
+		return err
+	}
+
+	*l = levelFlag(level)
+	return nil
+}
+
+// Octal file mode flag, e.g. 0660.
+type fileMode os.FileMode
+
+func (m *fileMode) String() string {
+	return fmt.Sprintf("%04o", uint32(*m))
+}
+
+func (m *fileMode) Set(s string) error {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid file mode %q, want octal such as 0660", s)
+	}
+
+	*m = fileMode(mode)
+	return nil
+}
+
+// Named rate limits, flag form "auth=0.2:5 read=10:20".
+type tierList map[string]ratelimit.Limit
+
+func (l *tierList) String() string {
+	var tiers []string
+	for name, limit := range *l {
+		tiers = append(tiers, fmt.Sprintf("%s=%g:%d", name, limit.Rate, limit.Burst))
+	}
+	sort.Strings(tiers)
+
+	return strings.Join(tiers, " ")
+}
+
+func (l *tierList) Set(s string) error {
+	return l.SetList(strings.Fields(s))
+}
+
+// Replaces the whole list, so a config file or flag can drop a default tier.
+func (l *tierList) SetList(items []string) error {
+	tiers := tierList{}
+
+	for _, field := range items {
+		name, limit, ok := strings.Cut(field, "=")
+		rps, burst, ok2 := strings.Cut(limit, ":")
+		if !ok || !ok2 || name == "" {
+			return fmt.Errorf("invalid tier %q, want name=rps:burst", field)
+		}
+
+		var err error
+		var tier ratelimit.Limit
+
+		tier.Rate, err = strconv.ParseFloat(rps, 64)
+		if err != nil || tier.Rate <= 0 {
+			return fmt.Errorf("invalid tier %q, rps must be a number greater than 0", field)
+		}
+
+		tier.Burst, err = strconv.Atoi(burst)
+		if err != nil || tier.Burst <= 0 {
+			return fmt.Errorf("invalid tier %q, burst must be a whole number greater than 0", field)
+		}
+
+		tiers[name] = tier
+	}
+
+	*l = tiers
+	return nil
+}
+
+// Limiter tier and cost for one route.
+type routeLimit struct {
+	tier string
+	cost int
+}
+
+// Keyed by "METHOD /pattern", flag form "POST:/v1/tokens/authentication=auth:1".
+type routeLimits map[string]routeLimit
+
+func (l *routeLimits) String() string {
+	var routes []string
+	for route, rl := range *l {
+		routes = append(routes, fmt.Sprintf("%s=%s:%d", strings.Replace(route, " ", ":", 1), rl.tier, rl.cost))
+	}
+	sort.Strings(routes)
+
+	return strings.Join(routes, " ")
+}
+
+func (l *routeLimits) Set(s string) error {
+	return l.SetList(strings.Fields(s))
+}
+
+func (l *routeLimits) SetList(items []string) error {
+	routes := routeLimits{}
+
+	for _, field := range items {
+		route, limit, ok := strings.Cut(field, "=")
+		method, pattern, ok2 := strings.Cut(route, ":")
+		tier, cost, ok3 := strings.Cut(limit, ":")
+		if !ok || !ok2 || !ok3 || method == "" || !strings.HasPrefix(pattern, "/") || tier == "" {
+			return fmt.Errorf("invalid route limit %q, want METHOD:/path=tier:cost", field)
+		}
+
+		n, err := strconv.Atoi(cost)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid route limit %q, cost must be a whole number of at least 1", field)
+		}
+
+		routes[routeKey(method, pattern)] = routeLimit{tier: tier, cost: n}
+	}
+
+	*l = routes
+	return nil
+}
+
+func newFlagSet(cfg *config) *flag.FlagSet {
+	fs := flag.NewFlagSet("api", flag.ContinueOnError)
+
+	fs.StringVar(&cfg.file, "config", "", "Path to TOML config file")
+
+	fs.IntVar(&cfg.port, "port", 4000, "API Server Port")
+	fs.StringVar(&cfg.unixSocket.path, "unix-socket", "", "Listen on this Unix socket instead of -port")
+	cfg.unixSocket.mode = 0660
+	fs.Var(&cfg.unixSocket.mode, "unix-socket-mode", "Permissions for -unix-socket (octal)")
+	fs.StringVar(&cfg.admin.addr, "admin-addr", "localhost:4001", "Address for the admin listener with expvar, pprof and metrics (empty disables it)")
+	fs.StringVar(&cfg.admin.unixSocket, "admin-unix-socket", "", "Serve the admin listener on this Unix socket (mode 0600) instead of -admin-addr")
+	fs.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
+	cfg.logLevel = levelFlag(jsonlog.LevelInfo)
+	fs.Var(&cfg.logLevel, "log-level", "Minimum log level (debug|info|warn|error|fatal|off)")
+	cfg.logStackLevel = levelFlag(jsonlog.DefaultStackLevel)
+	fs.Var(&cfg.logStackLevel, "log-stack-level", "Minimum level of log entries to include a stack trace in (debug|info|warn|error|fatal|off)")
+	cfg.logRedactKeys = spaceList{"password", "token", "authorization", "dsn"}
+	fs.Var(&cfg.logRedactKeys, "log-redact-keys", "Log properties to mask (space separated), emails and tokens in URLs always are")
+	fs.BoolVar(&cfg.accessLog.enabled, "access-log-enabled", true, "Log every request")
+	fs.Float64Var(&cfg.accessLog.sampleRate, "access-log-sample-rate", 1, "Fraction of 1xx/2xx requests to log (0-1), others are always logged")
+	fs.BoolVar(&cfg.accessLog.excludeHealth, "access-log-exclude-health", true, "Don't log health check requests")
+	fs.StringVar(&cfg.tracing.exporter, "tracing-exporter", "none", "Where to send traces (none|otlp|file)")
+	fs.StringVar(&cfg.tracing.endpoint, "tracing-endpoint", "http://localhost:4318/v1/traces", "OTLP/HTTP traces endpoint for -tracing-exporter=otlp")
+	fs.StringVar(&cfg.tracing.file, "tracing-file", "traces.jsonl", "File to append traces to for -tracing-exporter=file")
+	fs.Float64Var(&cfg.tracing.sampleRate, "tracing-sample-rate", 1, "Fraction of new traces to record (0-1), traces coming in with a traceparent follow the caller")
+	fs.DurationVar(&cfg.shutdownDelay, "shutdown-delay", 5*time.Second, "How long to fail readiness checks before shutting down, so load balancers stop sending us reqs first")
+
+	// DB cfg.
+	fs.StringVar(&cfg.db.dsn, "db-dsn", "", "Postgresql DSN")
+	fs.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
+	fs.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
+	fs.DurationVar(&cfg.db.maxIdleTime, "db-max-idle-time", 15*time.Minute, "PostgreSQL max connection idle time")
+	fs.DurationVar(&cfg.db.maxLifetime, "db-max-lifetime", 0, "PostgreSQL max connection lifetime (0 for no limit)")
+	fs.StringVar(&cfg.db.replicaDSN, "db-replica-dsn", "", "PostgreSQL read replica DSN (empty sends reads to the primary)")
+	fs.DurationVar(&cfg.db.replicaStickiness, "db-replica-stickiness", 5*time.Second, "How long a user's reads stay on the primary after they write")
+	fs.IntVar(&cfg.db.connectRetries, "db-connect-retries", 5, "Times to retry connecting to PostgreSQL at startup")
+	fs.DurationVar(&cfg.db.connectBackoff, "db-connect-backoff", 500*time.Millisecond, "Wait before the first connection retry, doubled each time")
+	fs.DurationVar(&cfg.db.connectMaxBackoff, "db-connect-max-backoff", 30*time.Second, "Longest wait between connection retries")
+
+	// Rate limiter.
+	fs.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limer max reqs /second")
+	fs.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter max burst")
+	fs.Float64Var(&cfg.limiter.ipRPS, "limiter-ip-rps", 20, "Max reqs /second per IP across all routes, checked before authentication")
+	fs.IntVar(&cfg.limiter.ipBurst, "limiter-ip-burst", 40, "Max burst per IP across all routes")
+	fs.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+	cfg.limiter.tiers = tierList{
+		"auth": {Rate: 0.2, Burst: 5},
+		"read": {Rate: 10, Burst: 20},
+	}
+	cfg.limiter.routes = routeLimits{}
+	fs.Var(&cfg.limiter.tiers, "limiter-tiers", "Extra limiter tiers as name=rps:burst (space separated), -limiter-rps/-limiter-burst are the default tier")
+	fs.Var(&cfg.limiter.routes, "limiter-routes", "Override route tiers/costs as METHOD:/path=tier:cost (space separated)")
+	fs.StringVar(&cfg.limiter.backend, "limiter-backend", "memory", "Where limiter state lives (memory|postgres), postgres shares it between instances")
+
+	// SMTP
+	fs.StringVar(&cfg.smtp.host, "smtp-host", "sandbox.smtp.mailtrap.io", "SMTP host")
+	fs.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
+	fs.StringVar(&cfg.smtp.username, "smtp-username", "", "SMTP username")
+	fs.StringVar(&cfg.smtp.password, "smtp-password", "", "SMTP password")
+	fs.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <no-reply@greenlight>", "SMTP sender")
+
+	// Password hashing (argon2id).
+	fs.UintVar(&cfg.password.memory, "password-argon2-memory", 64*1024, "Argon2id memory in KiB")
+	fs.UintVar(&cfg.password.iterations, "password-argon2-iterations", 3, "Argon2id iterations")
+	fs.UintVar(&cfg.password.parallelism, "password-argon2-parallelism", 2, "Argon2id parallelism")
+	fs.UintVar(&cfg.password.memoryBudget, "password-hashing-memory", 256*1024, "Memory in KiB that password hashes running at once may use, more wait their turn")
+	fs.StringVar(&cfg.password.breachedFile, "password-breached-file", "", "Sorted SHA-1 breached password file, at most 20M hashes (empty disables check)")
+	fs.IntVar(&cfg.password.minScore, "password-min-score", 2, "Minimum password strength score (0-4)")
+
+	// CORS
+	fs.Var((*spaceList)(&cfg.cors.trustedOrigins), "cors-trusted-origins", "Trusted CORS origins (space separated)")
+
+	// Forwarded headers are only believed from these. Unix socket peers are
+	// always trusted.
+	cfg.trustedProxies = []string{"127.0.0.1/8", "::1/128"}
+	fs.Var((*spaceList)(&cfg.trustedProxies), "trusted-proxies", "Reverse proxy IPs/CIDRs allowed to tell us the client IP (space separated)")
+	fs.StringVar(&cfg.proxyHeader, "trusted-proxy-header", clientip.XForwardedFor, "Header trusted proxies put the client IP in (X-Forwarded-For|Forwarded|X-Real-Ip)")
+
+	// Load shedding.
+	fs.IntVar(&cfg.shed.maxInFlight, "shed-max-inflight", 100, "Max reqs handled at once before shedding load (0 disables)")
+	fs.IntVar(&cfg.shed.maxInFlightRead, "shed-max-inflight-read", 80, "Max GET/HEAD reqs handled at once")
+	fs.IntVar(&cfg.shed.maxInFlightWrite, "shed-max-inflight-write", 40, "Max other reqs handled at once")
+	fs.IntVar(&cfg.shed.priorityReserve, "shed-priority-reserve", 10, "Slots kept free for health checks and authenticated writes")
+	fs.IntVar(&cfg.shed.maxQueue, "shed-max-queue", 50, "Max reqs waiting for a slot")
+	fs.IntVar(&cfg.shed.maxPriorityQueue, "shed-max-priority-queue", 10, "Max health checks and authenticated writes waiting for a slot")
+	fs.DurationVar(&cfg.shed.queueTimeout, "shed-queue-timeout", 250*time.Millisecond, "How long a req waits for a slot before getting a 503")
+
+	// TLS, plain HTTP if no cert is given.
+	fs.StringVar(&cfg.tls.cert, "tls-cert", "", "TLS certificate file, reloaded when it changes")
+	fs.StringVar(&cfg.tls.key, "tls-key", "", "TLS private key file")
+	fs.StringVar(&cfg.tls.minVersion, "tls-min-version", "1.2", "Minimum TLS version (1.2|1.3)")
+	fs.StringVar(&cfg.tls.clientCA, "tls-client-ca", "", "CA bundle for verifying client certificates (enables mTLS)")
+	fs.Var((*spaceList)(&cfg.tls.clientAccounts), "tls-client-accounts", "Service account emails that may log in with a client certificate (space separated)")
+
+	for _, name := range secretFlags {
+		fs.String(name+"-file", "", "Read -"+name+" from this file")
+	}
+
+	fs.BoolVar(&cfg.displayVersion, "version", false, "Display version and exit")
+
+	return fs
+}
+
+// Builds the config from all the layers. The returned flag set is bound to the
+// config, and fs.Args() holds whatever is left after the flags, i.e. any
+// subcommand.
+func loadConfig(args []string) (*config, *flag.FlagSet, error) {
+	cfg := &config{}
+	fs := newFlagSet(cfg)
+	fs.SetOutput(io.Discard)
+
+	// First pass is only to find out where the config file lives. Flags get
+	// parsed again at the end so they win over everything else.
+	err := fs.Parse(args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			fs.SetOutput(os.Stderr)
+			fs.Usage()
+		}
+		return nil, nil, err
+	}
+
+	file := cfg.file
+	if file == "" {
+		file = os.Getenv("GREENLIGHT_CONFIG")
+	}
+
+	if file != "" {
+		values, err := readConfigFile(file)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for key, value := range values {
+			name := strings.ReplaceAll(strings.ReplaceAll(key, ".", "-"), "_", "-")
+
+			f := fs.Lookup(name)
+			if name == "config" || name == "version" || f == nil {
+				return nil, nil, fmt.Errorf("%s: unknown setting %q", file, key)
+			}
+
+			list, isList := f.Value.(listValue)
+			switch {
+			case value.IsArray && isList:
+				err = list.SetList(value.Array)
+			case value.IsArray:
+				err = errors.New("expected a single value, not an array")
+			default:
+				err = fs.Set(name, value.Scalar)
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %s: %w", file, key, err)
+			}
+		}
+	}
+
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "version" {
+			return
+		}
+
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			if err := fs.Set(f.Name, value); err != nil && envErr == nil {
+				envErr = fmt.Errorf("%s: %w", envName(f.Name), err)
+			}
+		}
+	})
+	if envErr != nil {
+		return nil, nil, envErr
+	}
+
+	err = fs.Parse(args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Swap in secrets from files.
+	for _, name := range secretFlags {
+		path := fs.Lookup(name + "-file").Value.String()
+		if path == "" {
+			continue
+		}
+
+		if fs.Lookup(name).Value.String() != "" {
+			return nil, nil, fmt.Errorf("only one of %s and %s-file may be set", name, name)
+		}
+
+		secret, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = fs.Set(name, strings.TrimSpace(string(secret)))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	cfg.args = args
+	cfg.file = file
+
+	return cfg, fs, nil
+}
+
+func readConfigFile(path string) (map[string]toml.Value, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values, err := toml.Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return values, nil
+}
+
+// -db-max-open-conns -> GREENLIGHT_DB_MAX_OPEN_CONNS
+func envName(flagName string) string {
+	return "GREENLIGHT_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Limiter tier and cost for a route, from -limiter-routes, defaultRouteLimits
+// or the default tier in that order. ok is false if the tier doesn't exist.
+func (cfg *config) routeLimit(route string) (rl routeLimit, limit ratelimit.Limit, ok bool) {
+	rl, ok = cfg.limiter.routes[route]
+	if !ok {
+		rl, ok = defaultRouteLimits[route]
+	}
+	if !ok {
+		rl = routeLimit{tier: defaultTier, cost: 1}
+	}
+
+	if rl.tier == defaultTier {
+		return rl, ratelimit.Limit{Rate: cfg.limiter.rps, Burst: cfg.limiter.burst}, true
+	}
+
+	limit, ok = cfg.limiter.tiers[rl.tier]
+	return rl, limit, ok
+}
+
+// Sanity checks, so we fail at startup instead of on first use. Fills in the
+// settings built from others, e.g. clientIPs, as it goes.
+func (cfg *config) validate() error {
+	v := validator.New()
+
+	v.Check(cfg.port > 0 && cfg.port <= 65535, "port", "must be between 1 and 65535")
+	if cfg.admin.addr != "" {
+		_, _, err := net.SplitHostPort(cfg.admin.addr)
+		v.Check(err == nil, "admin-addr", "must be a host:port such as localhost:4001")
+	}
+	v.Check(validator.PermittedValue(cfg.env, "development", "staging", "production"), "env",
+		"must be development, staging or production")
+
+	v.Check(cfg.accessLog.sampleRate >= 0 && cfg.accessLog.sampleRate <= 1, "access-log-sample-rate",
+		"must be between 0 and 1")
+
+	v.Check(validator.PermittedValue(cfg.tracing.exporter, "none", "otlp", "file"), "tracing-exporter",
+		"must be none, otlp or file")
+	if cfg.tracing.exporter == "otlp" {
+		u, err := url.Parse(cfg.tracing.endpoint)
+		v.Check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "tracing-endpoint",
+			"must be an http(s) URL")
+	}
+	v.Check(cfg.tracing.exporter != "file" || cfg.tracing.file != "", "tracing-file", "must be provided")
+	v.Check(cfg.tracing.sampleRate >= 0 && cfg.tracing.sampleRate <= 1, "tracing-sample-rate",
+		"must be between 0 and 1")
+
+	v.Check(cfg.shutdownDelay >= 0, "shutdown-delay", "must not be negative")
+
+	v.Check(cfg.db.dsn != "", "db-dsn", "must be provided")
+	v.Check(cfg.db.maxOpenConns > 0, "db-max-open-conns", "must be greater than 0")
+	v.Check(cfg.db.maxIdleConns >= 0, "db-max-idle-conns", "must not be negative")
+	v.Check(cfg.db.maxLifetime >= 0, "db-max-lifetime", "must not be negative")
+	v.Check(cfg.db.replicaStickiness >= 0, "db-replica-stickiness", "must not be negative")
+	v.Check(cfg.db.connectRetries >= 0, "db-connect-retries", "must not be negative")
+	v.Check(cfg.db.connectBackoff > 0, "db-connect-backoff", "must be greater than 0")
+	v.Check(cfg.db.connectMaxBackoff >= cfg.db.connectBackoff, "db-connect-max-backoff",
+		"must be no shorter than db-connect-backoff")
+
+	v.Check(cfg.limiter.rps > 0, "limiter-rps", "must be greater than 0")
+	v.Check(cfg.limiter.burst > 0, "limiter-burst", "must be greater than 0")
+	v.Check(cfg.limiter.ipRPS > 0, "limiter-ip-rps", "must be greater than 0")
+	v.Check(cfg.limiter.ipBurst > 0, "limiter-ip-burst", "must be greater than 0")
+	v.Check(validator.PermittedValue(cfg.limiter.backend, "memory", "postgres"), "limiter-backend",
+		"must be memory or postgres")
+	for _, routes := range []routeLimits{defaultRouteLimits, cfg.limiter.routes} {
+		for route := range routes {
+			rl, limit, ok := cfg.routeLimit(route)
+			v.Check(ok, "limiter-routes", fmt.Sprintf("%s uses unknown tier %q", route, rl.tier))
+			v.Check(!ok || rl.cost <= limit.Burst, "limiter-routes",
+				fmt.Sprintf("%s costs more than the %s tier's burst", route, rl.tier))
+		}
+	}
+
+	_, err := clientip.New(nil, cfg.proxyHeader)
+	v.Check(err == nil, "trusted-proxy-header", "must be X-Forwarded-For, Forwarded or X-Real-Ip")
+	if err == nil {
+		cfg.clientIPs, err = clientip.New(cfg.trustedProxies, cfg.proxyHeader)
+		v.Check(err == nil, "trusted-proxies", "must be IP addresses or CIDRs")
+	}
+
+	v.Check(cfg.shed.maxInFlight >= 0, "shed-max-inflight", "must not be negative")
+	if cfg.shed.maxInFlight > 0 {
+		v.Check(cfg.shed.maxInFlightRead > 0, "shed-max-inflight-read", "must be greater than 0")
+		v.Check(cfg.shed.maxInFlightWrite > 0, "shed-max-inflight-write", "must be greater than 0")
+		v.Check(cfg.shed.priorityReserve >= 0 && cfg.shed.priorityReserve < cfg.shed.maxInFlight,
+			"shed-priority-reserve", "must be at least 0 and less than shed-max-inflight")
+		v.Check(cfg.shed.maxQueue >= 0, "shed-max-queue", "must not be negative")
+		v.Check(cfg.shed.maxPriorityQueue >= 0, "shed-max-priority-queue", "must not be negative")
+		v.Check(cfg.shed.queueTimeout >= 0, "shed-queue-timeout", "must not be negative")
+	}
+
+	v.Check(cfg.smtp.port > 0 && cfg.smtp.port <= 65535, "smtp-port", "must be between 1 and 65535")
+	v.Check(cfg.smtp.sender != "", "smtp-sender", "must be provided")
+
+	v.Check((cfg.tls.cert == "") == (cfg.tls.key == ""), "tls-cert", "must be given together with tls-key")
+	v.Check(cfg.tls.clientCA == "" || cfg.tls.cert != "", "tls-client-ca", "needs tls-cert and tls-key")
+	v.Check(len(cfg.tls.clientAccounts) == 0 || cfg.tls.clientCA != "", "tls-client-accounts", "needs tls-client-ca")
+	_, ok := tlsVersions[cfg.tls.minVersion]
+	v.Check(ok, "tls-min-version", "must be 1.2 or 1.3")
+
+	v.Check(cfg.password.iterations >= 1 && cfg.password.iterations <= 100, "password-argon2-iterations",
+		"must be between 1 and 100")
+	v.Check(cfg.password.parallelism >= 1 && cfg.password.parallelism <= 255,
+		"password-argon2-parallelism", "must be between 1 and 255")
+	v.Check(cfg.password.memory >= 8*cfg.password.parallelism, "password-argon2-memory",
+		"must be at least 8 KiB per unit of parallelism")
+	v.Check(cfg.password.memory <= 4*1024*1024, "password-argon2-memory", "must be at most 4 GiB")
+	v.Check(cfg.password.memoryBudget >= cfg.password.memory, "password-hashing-memory",
+		"must be at least password-argon2-memory")
+	v.Check(cfg.password.minScore >= 0 && cfg.password.minScore <= 4, "password-min-score",
+		"must be between 0 and 4")
+
+	if v.Valid() {
+		return nil
+	}
+
+	// Sorted so the message is stable.
+	var problems []string
+	for key, msg := range v.Errors {
+		problems = append(problems, key+" "+msg)
+	}
+	sort.Strings(problems)
+
+	return errors.New("invalid config: " + strings.Join(problems, "; "))
+}
+
+// `api config print`. Shows the effective value of every setting, after all
+// layers have been applied, with secrets blanked out. Values in overrides win
+// over what fs holds, for settings reloaded since.
+func printConfig(w io.Writer, cfg *config, fs *flag.FlagSet, overrides map[string]string) {
+	if cfg.file != "" {
+		fmt.Fprintf(w, "# config file: %s\n", cfg.file)
+	}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "version" {
+			return
+		}
+
+		value, ok := overrides[f.Name]
+		if !ok {
+			value = f.Value.String()
+		}
+		if slices.Contains(secretFlags, f.Name) && value != "" {
+			value = "[redacted]"
+		}
+
+		fmt.Fprintf(w, "%s = %q\n", f.Name, value)
+	})
+}
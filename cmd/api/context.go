@@ -3,6 +3,9 @@ package main
 import (
 	"context"
 	"greenlight/internal/data"
+	"greenlight/internal/jsonlog"
+	"greenlight/internal/mailer"
+	"greenlight/internal/tracing"
 	"net/http"
 )
 
@@ -12,12 +15,72 @@ type contextKey string
 // This is what we'll use as key
 const userContextKey = contextKey("user")
 
+const clientIPContextKey = contextKey("client_ip")
+
+const requestIDContextKey = contextKey("request_id")
+
+const requestInfoContextKey = contextKey("request_info")
+
+const permissionsContextKey = contextKey("permissions")
+
+// Filled in further down the chain than where it's read, e.g. the route is only
+// known once httprouter has matched it. Lets outer middleware like accessLog
+// see those things. Only ever touched by the goroutine serving the req.
+type requestInfo struct {
+	route  string
+	userID int64
+
+	// What was sent back, see recordResponse.
+	response *metricsResponseWriter
+}
+
+// The status sent back. Nothing written at all means an empty 200.
+func (info *requestInfo) status() int {
+	if info.response.statusCode == 0 {
+		return http.StatusOK
+	}
+
+	return info.response.statusCode
+}
+
+// The user's permissions, loaded by permissionsFor on first use so rateLimit,
+// requirePermission and handlers share one query per req. Same goroutine rule
+// as requestInfo.
+type permissionsCache struct {
+	loaded      bool
+	permissions data.Permissions
+}
+
 // Returns a new copy of the request with the provided User struct added to ctx.
+// Comes with an empty permissions cache, so it never has another user's.
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
+	ctx = context.WithValue(ctx, permissionsContextKey, &permissionsCache{})
 	return r.WithContext(ctx)
 }
 
+// The req user's permissions, from the db the first time they're asked for.
+func (app *application) permissionsFor(r *http.Request) (data.Permissions, error) {
+	user := app.contextGetUser(r)
+
+	cache, ok := r.Context().Value(permissionsContextKey).(*permissionsCache)
+	if !ok {
+		return app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+	}
+
+	if !cache.loaded {
+		permissions, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		cache.permissions = permissions
+		cache.loaded = true
+	}
+
+	return cache.permissions, nil
+}
+
 // Retrieves the User struct from the req ctx. We only gonna use this when we
 // expect a user struct val in ctx, so OK to panic if not there.
 func (app *application) contextGetUser(r *http.Request) *data.User {
@@ -29,3 +92,92 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 
 	return user
 }
+
+// The client IP worked out by resolveClientIP. Use this rather than
+// r.RemoteAddr or any headers, so everything agrees on who the client is.
+func (app *application) contextSetClientIP(r *http.Request, ip string) *http.Request {
+	ctx := context.WithValue(r.Context(), clientIPContextKey, ip)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetClientIP(r *http.Request) string {
+	ip, ok := r.Context().Value(clientIPContextKey).(string)
+	if !ok {
+		panic("missing client ip value in req ctx")
+	}
+
+	return ip
+}
+
+func (app *application) contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// Takes a ctx rather than a req so background jobs can use it too. Empty if
+// there's no request ID, e.g. outside of a req.
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
+
+// Logger that tags entries with the request and trace IDs from ctx, if any.
+func (app *application) loggerFor(ctx context.Context) *jsonlog.Logger {
+	properties := map[string]any{}
+
+	if id := requestIDFromContext(ctx); id != "" {
+		properties["request_id"] = id
+	}
+	if id := tracing.TraceIDFromContext(ctx); id != "" {
+		properties["trace_id"] = id
+	}
+
+	if len(properties) == 0 {
+		return app.logger
+	}
+
+	return app.logger.With(properties)
+}
+
+// Mailer that puts the request ID from ctx, if any, in an X-Request-ID header,
+// so a bounce or complaint can be traced back to the req that sent it. The
+// trace goes along in a Traceparent header too.
+func (app *application) mailerFor(ctx context.Context) mailer.Mailer {
+	m := *app.mailer.Load()
+
+	headers := map[string]string{}
+
+	if id := requestIDFromContext(ctx); id != "" {
+		headers["X-Request-ID"] = id
+	}
+	if traceparent := tracing.Traceparent(ctx); traceparent != "" {
+		headers["Traceparent"] = traceparent
+	}
+
+	if len(headers) == 0 {
+		return m
+	}
+
+	return m.WithHeaders(headers)
+}
+
+func (app *application) contextSetRequestInfo(r *http.Request, info *requestInfo) *http.Request {
+	ctx := context.WithValue(r.Context(), requestInfoContextKey, info)
+	return r.WithContext(ctx)
+}
+
+// Returns the req's requestInfo, setting one up if no outer middleware has.
+func (app *application) requestInfoFor(r *http.Request) (*http.Request, *requestInfo) {
+	if info := app.contextGetRequestInfo(r); info != nil {
+		return r, info
+	}
+
+	info := &requestInfo{}
+	return app.contextSetRequestInfo(r, info), info
+}
+
+// nil if no middleware set one up.
+func (app *application) contextGetRequestInfo(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestInfoContextKey).(*requestInfo)
+	return info
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"greenlight/internal/data"
+	"greenlight/internal/jsonlog"
+	"greenlight/internal/validator"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// How many frames from where it panicked go into the fingerprint, enough to
+// tell apart callers of a shared helper.
+const fingerprintFrames = 3
+
+// Frames left out of fingerprints. The HandlerFunc adapters and span wrappers
+// come and go with config (e.g. tracing), the code that panicked doesn't.
+func fingerprintSkips(function string) bool {
+	return strings.HasPrefix(function, "runtime.") ||
+		strings.HasPrefix(function, "net/http.") ||
+		strings.Contains(function, ".(*application).traced.")
+}
+
+// A recovered panic, with the stack from where it happened. The stack in the
+// log entry itself would only show where we logged it.
+type panicError struct {
+	value       any
+	origin      string // Function and file:line that panicked.
+	fingerprint string // Same for panics of the same type from the same place.
+	stack       string
+}
+
+// Call it in the deferred func that recovered, while the panicking frames
+// are still on the stack.
+func newPanicError(value any) *panicError {
+	pcs := make([]uintptr, 64)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(1, pcs)])
+
+	// The origin is the first frame after the runtime's own panic handling.
+	// The fingerprint leaves out line numbers so a report survives unrelated
+	// edits to the file.
+	var origin string
+	var functions []string
+	panicking := false
+	for {
+		frame, more := frames.Next()
+
+		switch {
+		case frame.Function == "runtime.gopanic":
+			panicking = true
+		case panicking && !strings.HasPrefix(frame.Function, "runtime."):
+			if origin == "" {
+				origin = fmt.Sprintf("%s %s:%d", frame.Function, frame.File, frame.Line)
+			}
+			if !fingerprintSkips(frame.Function) {
+				functions = append(functions, frame.Function)
+			}
+		}
+
+		if len(functions) == fingerprintFrames || !more {
+			break
+		}
+	}
+
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%T\n%s", value, strings.Join(functions, "\n"))))
+
+	return &panicError{
+		value:       value,
+		origin:      origin,
+		fingerprint: hex.EncodeToString(sum[:16]),
+		stack:       string(debug.Stack()),
+	}
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprint(e.value)
+}
+
+// Saves a crash report for panicErr in the background. r is the req that
+// panicked, nil for a background job. The message and stack are redacted like
+// log entries, panic values can have anything in them.
+func (app *application) reportPanic(ctx context.Context, panicErr *panicError, r *http.Request) {
+	report := &data.CrashReport{
+		Fingerprint: panicErr.fingerprint,
+		Message:     jsonlog.Redact(panicErr.Error()),
+		Origin:      panicErr.origin,
+		Stack:       jsonlog.Redact(panicErr.stack),
+		RequestID:   requestIDFromContext(ctx),
+	}
+
+	if r != nil {
+		report.Method = r.Method
+
+		if info := app.contextGetRequestInfo(r); info != nil {
+			report.Route = info.route
+			report.UserID = info.userID
+		}
+
+		// Panicked before a route matched, but maybe after authenticate.
+		user, ok := r.Context().Value(userContextKey).(*data.User)
+		if ok && report.UserID == 0 && !user.IsAnonymous() {
+			report.UserID = user.ID
+		}
+	}
+
+	app.background(ctx, func(ctx context.Context) {
+		err := app.models.Crashes.Record(ctx, report)
+		if err != nil {
+			app.loggerFor(ctx).PrintError(err, map[string]any{"crash_fingerprint": report.Fingerprint})
+		}
+	})
+}
+
+// Most recently seen first by default.
+func (app *application) listCrashReportsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-last_seen")
+	input.Filters.SortSafeList = []string{"id", "count", "first_seen", "last_seen",
+		"-id", "-count", "-first_seen", "-last_seen"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	reports, metadata, err := app.models.Crashes.GetAll(r.Context(), input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"crash_reports": reports, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The admin listener uses a plain ServeMux, so the id is whatever follows
+// /debug/crashes/.
+func (app *application) showCrashReportHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/debug/crashes/"), 10, 64)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	report, err := app.models.Crashes.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"crash_report": report}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -1,16 +1,34 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"greenlight/internal/data"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 // Generic helper for logging an error message.
 func (app *application) logError(r *http.Request, err error) {
-	app.logger.PrintError(err, map[string]string{
+	properties := map[string]any{
 		"request_method": r.Method,
 		"request_url":    r.URL.String(),
-	})
+	}
+
+	// Not set if we got here before resolveClientIP ran.
+	if ip, ok := r.Context().Value(clientIPContextKey).(string); ok {
+		properties["client_ip"] = ip
+	}
+
+	var panicErr *panicError
+	if errors.As(err, &panicErr) {
+		properties["panic_origin"] = panicErr.origin
+		properties["crash_fingerprint"] = panicErr.fingerprint
+		properties["stack"] = panicErr.stack
+	}
+
+	app.loggerFor(r.Context()).PrintError(err, properties)
 }
 
 // Generic helper for sending JSON-formatted error msgs to client with given
@@ -19,6 +37,11 @@ func (app *application) errorResponse(w http.ResponseWriter, r *http.Request,
 	status int, message any) {
 	env := envelope{"error": message}
 
+	// So a user reporting an error can give us something to find it by.
+	if id := requestIDFromContext(r.Context()); id != "" {
+		env["request_id"] = id
+	}
+
 	// Write the response using writeJSON() helper
 	err := app.writeJSON(w, status, env, nil)
 	if err != nil {
@@ -29,11 +52,39 @@ func (app *application) errorResponse(w http.ResponseWriter, r *http.Request,
 }
 
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	// Constraints the db caught but our own validation missed are still the
+	// client's fault, so report them like any other failed validation.
+	var constraintErr *data.ConstraintError
+	if errors.As(err, &constraintErr) {
+		app.failedValidationResponse(w, r, constraintErr.Errors())
+		return
+	}
+
 	app.logError(r, err)
+
+	// Deadlocks, dropped connections etc. Let the client know it's worth
+	// trying again rather than reporting a hard failure.
+	if data.IsRetryable(err) {
+		app.temporarilyUnavailableResponse(w, r)
+		return
+	}
+
 	msg := "the server encountererd a problem and could not process your request"
 	app.errorResponse(w, r, http.StatusInternalServerError, msg)
 }
 
+func (app *application) temporarilyUnavailableResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "1")
+	msg := "the server is temporarily unable to process your request, please try again"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, msg)
+}
+
+func (app *application) overloadedResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "1")
+	msg := "the server is too busy to process your request right now, please try again"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, msg)
+}
+
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
 	msg := "the requested resource could not be found"
 	app.errorResponse(w, r, http.StatusNotFound, msg)
@@ -58,7 +109,10 @@ func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Requ
 	app.errorResponse(w, r, http.StatusConflict, message)
 }
 
-func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
+func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request,
+	retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(max(ceilSeconds(retryAfter), 1)))
+
 	message := "rate limit exceeded"
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
@@ -76,6 +130,11 @@ func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
+func (app *application) unknownClientCertificateResponse(w http.ResponseWriter, r *http.Request) {
+	message := "client certificate doesn't match any active service account"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
 	message := "you must be authenticated to access this resource"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
 	"net/http"
+	"sync"
+	"time"
 )
 
 func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
@@ -20,3 +23,196 @@ func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 }
+
+const (
+	// Past this many background jobs at once something's stuck, probably SMTP.
+	maxBackgroundJobs = 100
+
+	// Dialing SMTP on every probe would be rude, so the result is cached.
+	mailerCheckInterval = 30 * time.Second
+)
+
+// Outcome of a single readiness check. Only critical checks take the instance
+// out of rotation, the rest are just reported.
+type healthCheck struct {
+	Status   string `json:"status"`
+	Critical bool   `json:"critical"`
+	Detail   any    `json:"detail,omitempty"`
+}
+
+func passing(critical bool, detail any) healthCheck {
+	return healthCheck{Status: "pass", Critical: critical, Detail: detail}
+}
+
+func failing(critical bool, detail any) healthCheck {
+	return healthCheck{Status: "fail", Critical: critical, Detail: detail}
+}
+
+type healthCache struct {
+	mu         sync.Mutex
+	mailer     healthCheck
+	checkedAt  time.Time
+	refreshing bool
+}
+
+// The process is up and serving requests. Doesn't touch any dependencies, so
+// an outage elsewhere never gets us restarted.
+func (app *application) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{"status": "alive"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Whether we should be sent traffic. 503 once shutdown has started or if a
+// critical dependency is down. This is public, so it only says which checks
+// pass. The details, which can have hostnames and driver errors in them, are
+// logged and served on the admin listener (see healthDetailHandler).
+func (app *application) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	checks := app.readinessChecks(r.Context())
+
+	statuses := make(map[string]string, len(checks))
+	for name, check := range checks {
+		statuses[name] = check.Status
+	}
+
+	status, ready := readiness(checks)
+
+	err := app.writeJSON(w, status, envelope{"status": ready, "checks": statuses}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Like readinessHandler, with each check's details.
+func (app *application) healthDetailHandler(w http.ResponseWriter, r *http.Request) {
+	checks := app.readinessChecks(r.Context())
+	status, ready := readiness(checks)
+
+	err := app.writeJSON(w, status, envelope{"status": ready, "checks": checks}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) readinessChecks(ctx context.Context) map[string]healthCheck {
+	return map[string]healthCheck{
+		"shutdown": app.checkShutdown(),
+		"database": app.checkDatabase(ctx),
+		"pool":     app.checkPool(),
+		"replica":  app.checkReplica(),
+		"mailer":   app.checkMailer(),
+		"jobs":     app.checkJobs(),
+	}
+}
+
+// The status code and status for checks, 503 if any critical one isn't passing.
+func readiness(checks map[string]healthCheck) (int, string) {
+	for _, check := range checks {
+		if check.Critical && check.Status != "pass" {
+			return http.StatusServiceUnavailable, "unavailable"
+		}
+	}
+
+	return http.StatusOK, "ready"
+}
+
+func (app *application) checkShutdown() healthCheck {
+	if app.shuttingDown.Load() {
+		return failing(true, "shutting down")
+	}
+	return passing(true, nil)
+}
+
+func (app *application) checkDatabase(ctx context.Context) healthCheck {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	start := time.Now()
+
+	err := app.db.PingContext(ctx)
+	if err != nil {
+		app.logger.PrintError(err, map[string]any{"check": "database"})
+		return failing(true, err.Error())
+	}
+
+	return passing(true, map[string]string{"latency": time.Since(start).String()})
+}
+
+// Reads fall back to the primary while the replica is down, so not critical.
+func (app *application) checkReplica() healthCheck {
+	switch {
+	case app.db.Replica() == nil:
+		return passing(false, "not configured")
+	case !app.db.ReplicaHealthy():
+		return failing(false, "reads are going to the primary")
+	default:
+		return passing(false, nil)
+	}
+}
+
+// Every connection busy and requests queueing for one. Not critical, another
+// instance would most likely be in the same boat.
+func (app *application) checkPool() healthCheck {
+	stats := app.db.Stats()
+
+	detail := map[string]int{
+		"open":     stats.OpenConnections,
+		"in_use":   stats.InUse,
+		"idle":     stats.Idle,
+		"max_open": stats.MaxOpenConnections,
+	}
+
+	if stats.MaxOpenConnections > 0 && stats.InUse >= stats.MaxOpenConnections {
+		return failing(false, detail)
+	}
+
+	return passing(false, detail)
+}
+
+// Mail goes out in the background and gets retried, so a broken SMTP server
+// shouldn't take us out of rotation. Dialing can take seconds, so it happens
+// off the request and the probe gets the last known result.
+func (app *application) checkMailer() healthCheck {
+	app.health.mu.Lock()
+	defer app.health.mu.Unlock()
+
+	if !app.health.refreshing && time.Since(app.health.checkedAt) >= mailerCheckInterval {
+		app.health.refreshing = true
+
+		go func() {
+			check := passing(false, nil)
+
+			err := app.mailer.Load().Ping()
+			if err != nil {
+				app.logger.PrintError(err, map[string]any{"check": "mailer"})
+				check = failing(false, err.Error())
+			}
+
+			app.health.mu.Lock()
+			app.health.mailer = check
+			app.health.checkedAt = time.Now()
+			app.health.refreshing = false
+			app.health.mu.Unlock()
+		}()
+	}
+
+	if app.health.checkedAt.IsZero() {
+		return healthCheck{Status: "unknown", Critical: false}
+	}
+
+	return app.health.mailer
+}
+
+func (app *application) checkJobs() healthCheck {
+	detail := map[string]int64{
+		"running": app.jobs.running.Load(),
+		"panics":  app.jobs.panics.Load(),
+	}
+
+	if detail["running"] > maxBackgroundJobs {
+		return failing(false, detail)
+	}
+
+	return passing(false, detail)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -156,21 +157,35 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 }
 
 // Spin up goroutine and run `fn`, using a deferred func to recover any panics and log.
-func (app *application) background(fn func()) {
+// fn gets a ctx with the values from ctx, e.g. the request ID, but which isn't
+// cancelled when the request finishes.
+func (app *application) background(ctx context.Context, fn func(ctx context.Context)) {
+	ctx = context.WithoutCancel(ctx)
+
 	// Increment wait group counter.
 	app.wg.Add(1)
+	app.jobs.started.Add(1)
+	app.jobs.running.Add(1)
 
 	go func() {
 		// Decr counter before goroutine returns.
 		defer app.wg.Done()
+		defer app.jobs.running.Add(-1)
 
 		defer func() {
 			if err := recover(); err != nil {
-				app.logger.PrintError(fmt.Errorf("%s", err), nil)
+				app.jobs.panics.Add(1)
+				panicErr := newPanicError(err)
+				app.loggerFor(ctx).PrintError(panicErr, map[string]any{
+					"panic_origin":      panicErr.origin,
+					"crash_fingerprint": panicErr.fingerprint,
+					"stack":             panicErr.stack,
+				})
+				app.reportPanic(ctx, panicErr, nil)
 			}
 
 		}()
 
-		fn()
+		fn(ctx)
 	}()
 }
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"greenlight/internal/data"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Caps how many reqs we work on at once, so a burst gets a quick 503 instead
+// of piling up on the DB pool until everything times out.
+//
+// Every req needs a global slot, the last -shed-priority-reserve of which only
+// priority reqs (health checks, authenticated writes) may use. Other reqs
+// also need a slot for their class, reads or writes. When no slot is free a req
+// waits up to -shed-queue-timeout, but only if fewer than -shed-max-queue are
+// already waiting, or -shed-max-priority-queue for priority reqs.
+type loadShedder struct {
+	global  chan struct{}
+	normal  chan struct{}
+	classes map[string]chan struct{}
+
+	maxQueue         int64
+	queued           atomic.Int64
+	maxPriorityQueue int64
+	priorityQueued   atomic.Int64
+	queueTimeout     time.Duration
+
+	inFlight atomic.Int64
+	shed     *expvar.Map
+}
+
+func newLoadShedder(cfg config) *loadShedder {
+	ls := &loadShedder{
+		global: make(chan struct{}, cfg.shed.maxInFlight),
+		normal: make(chan struct{}, cfg.shed.maxInFlight-cfg.shed.priorityReserve),
+		classes: map[string]chan struct{}{
+			"read":  make(chan struct{}, cfg.shed.maxInFlightRead),
+			"write": make(chan struct{}, cfg.shed.maxInFlightWrite),
+		},
+		maxQueue:         int64(cfg.shed.maxQueue),
+		maxPriorityQueue: int64(cfg.shed.maxPriorityQueue),
+		queueTimeout:     cfg.shed.queueTimeout,
+		shed:             expvar.NewMap("load_shed_total"),
+	}
+
+	expvar.Publish("load_shed_in_flight", expvar.Func(func() any {
+		return ls.inFlight.Load()
+	}))
+	expvar.Publish("load_shed_queued", expvar.Func(func() any {
+		return ls.queued.Load()
+	}))
+	expvar.Publish("load_shed_priority_queued", expvar.Func(func() any {
+		return ls.priorityQueued.Load()
+	}))
+
+	return ls
+}
+
+func requestClass(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return "read"
+	default:
+		return "write"
+	}
+}
+
+// Writes that carry credentials, a bearer token or a verified client cert.
+// They skip shedLoad and are shed by shedAuthenticated instead, once
+// authenticate knows whether the credentials are any good.
+func hasCredentials(r *http.Request) bool {
+	return r.Header.Get("Authorization") != "" || (r.TLS != nil && len(r.TLS.VerifiedChains) > 0)
+}
+
+// Health checks have to get through or we'd be pulled out of rotation for being
+// busy. Writes by authenticated users are someone's actual work, worth more
+// than yet another anonymous read.
+func (app *application) isPriority(r *http.Request) bool {
+	if isHealthProbe(r) {
+		return true
+	}
+
+	// No user yet before authenticate, see shedLoad.
+	user, ok := r.Context().Value(userContextKey).(*data.User)
+
+	return ok && requestClass(r) == "write" && !user.IsAnonymous()
+}
+
+// Takes a slot from sem, waiting in the queue until ctx is done if need be.
+// Reports whether it got one. Priority reqs have a queue of their own, so they
+// never wait behind a flood of normal ones.
+func (ls *loadShedder) acquire(ctx context.Context, sem chan struct{}, priority bool) bool {
+	select {
+	case sem <- struct{}{}:
+		return true
+	default:
+	}
+
+	queued, maxQueue := &ls.queued, ls.maxQueue
+	if priority {
+		queued, maxQueue = &ls.priorityQueued, ls.maxPriorityQueue
+	}
+
+	if queued.Add(1) > maxQueue {
+		queued.Add(-1)
+		return false
+	}
+	defer queued.Add(-1)
+
+	select {
+	case sem <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func release(sem chan struct{}) {
+	<-sem
+}
+
+// Serves r once it has all the slots it needs, or sends a 503 if it can't get
+// them within -shed-queue-timeout, counted from the first one.
+func (ls *loadShedder) serve(app *application, w http.ResponseWriter, r *http.Request, next http.Handler) {
+	class := requestClass(r)
+	priority := app.isPriority(r)
+
+	// Priority reqs skip the class and normal limits, which leaves them the
+	// reserved global slots.
+	var sems []chan struct{}
+	if !priority {
+		sems = append(sems, ls.classes[class], ls.normal)
+	}
+	sems = append(sems, ls.global)
+
+	ctx, cancel := context.WithTimeout(r.Context(), ls.queueTimeout)
+	defer cancel()
+
+	for i, sem := range sems {
+		if !ls.acquire(ctx, sem, priority) {
+			for _, held := range sems[:i] {
+				release(held)
+			}
+
+			if priority {
+				ls.shed.Add("priority", 1)
+			} else {
+				ls.shed.Add(class, 1)
+			}
+
+			app.overloadedResponse(w, r)
+			return
+		}
+	}
+
+	ls.inFlight.Add(1)
+	defer func() {
+		ls.inFlight.Add(-1)
+		for _, sem := range sems {
+			release(sem)
+		}
+	}()
+
+	next.ServeHTTP(w, r)
+}
+
+// Sheds everything but writes with credentials, which wait for
+// shedAuthenticated. Runs early, before we spend anything on the req. A flood
+// of writes with made up tokens gets past this, but not past limitByIP.
+func (app *application) shedLoad(next http.Handler) http.Handler {
+	if app.shedder == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestClass(r) == "write" && hasCredentials(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		app.shedder.serve(app, w, r, next)
+	})
+}
+
+// Sheds the writes shedLoad let through, after authenticate, so the ones from
+// real users can be priority. Same slots and queues as shedLoad.
+func (app *application) shedAuthenticated(next http.Handler) http.Handler {
+	if app.shedder == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestClass(r) != "write" || !hasCredentials(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		app.shedder.serve(app, w, r, next)
+	})
+}
@@ -3,16 +3,24 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
+	"greenlight/internal/clientip"
 	"greenlight/internal/data"
 	"greenlight/internal/jsonlog"
+	"greenlight/internal/metrics"
+	"greenlight/internal/ratelimit"
+	"greenlight/internal/tracing"
 	"greenlight/internal/vcs"
+	"log/slog"
+	"math/rand"
 	"os"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"greenlight/internal/mailer"
@@ -25,86 +33,101 @@ var (
 	version = vcs.Version()
 )
 
-// Struct to hold all config settings for the app.
-// Will read in these settings from cmd flags.
-type config struct {
-	port int
-	env  string
-	db   struct {
-		dsn          string
-		maxOpenConns int
-		maxIdleConns int
-		maxIdleTime  string
-	}
-	limiter struct {
-		rps     float64
-		burst   int
-		enabled bool
-	}
-	smtp struct {
-		host     string
-		port     int
-		username string
-		password string
-		sender   string
-	}
-	cors struct {
-		trustedOrigins []string
-	}
-}
+// How often to check the read replica is still up.
+const replicaCheckInterval = 5 * time.Second
 
 // App struct to hold deps for our HTTP handlers
 type application struct {
-	config config
-	logger *jsonlog.Logger
-	models data.Models
-	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	// Config as the app was started. Settings that can be reloaded on SIGHUP
+	// (see reload.go) must be read through liveConfig() instead.
+	config    config
+	flags     *flag.FlagSet // What config was parsed with, see configHandler.
+	live      atomic.Pointer[config]
+	logger    *jsonlog.Logger
+	db        *data.DB
+	models    data.Models
+	limiter   ratelimit.Limiter
+	shedder   *loadShedder // nil if -shed-max-inflight is 0.
+	clientIPs *clientip.Resolver
+	mailer    atomic.Pointer[mailer.Mailer]
+	registry  *metrics.Registry // For /metrics, see metrics.go.
+	tracer    *tracing.Tracer   // nil unless -tracing-exporter is set.
+	wg        sync.WaitGroup
+
+	// Background jobs, see background().
+	jobs struct {
+		started atomic.Int64
+		running atomic.Int64
+		panics  atomic.Int64
+	}
+
+	// Set as soon as we get SIGINT/SIGTERM, so readiness fails while we drain.
+	shuttingDown atomic.Bool
+	health       healthCache
+
+	// Users' last writes, so their reads stay on the primary for a bit. See
+	// stickyReads.
+	lastWrites lastWrites
 }
 
 func main() {
-	var cfg config
+	cfg, fs, err := loadConfig(os.Args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
-	flag.IntVar(&cfg.port, "port", 4000, "API Server Port")
-	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
+	// Print version number flag
+	if cfg.displayVersion {
+		fmt.Printf("Version:\t%s\n", version)
+		os.Exit(0)
+	}
 
-	// DB cfg.
-	flag.StringVar(&cfg.db.dsn, "db-dsn", "", "Postgresql DSN")
-	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
-	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
-	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "PostgreSQL max connection idle time")
+	args := fs.Args()
 
-	// Rate limiter.
-	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limer max reqs /second")
-	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter max burst")
-	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+	// `api config print` doesn't need a valid config, let alone a db.
+	if len(args) == 2 && args[0] == "config" && args[1] == "print" {
+		printConfig(os.Stdout, cfg, fs, nil)
+		os.Exit(0)
+	}
 
-	// SMTP
-	flag.StringVar(&cfg.smtp.host, "smtp-host", "sandbox.smtp.mailtrap.io", "SMTP host")
-	flag.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
-	flag.StringVar(&cfg.smtp.username, "smtp-username", "a7303712992c04", "SMTP username")
-	flag.StringVar(&cfg.smtp.password, "smtp-password", "fcbce4d2ec04cd", "SMTP password")
-	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <no-reply@greenlight>", "SMTP sender")
+	logger := jsonlog.New(os.Stdout, jsonlog.Level(cfg.logLevel))
 
-	// CORS
-	flag.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(s string) error {
-		cfg.cors.trustedOrigins = strings.Fields(s)
-		return nil
-	})
+	// Libraries logging through slog (or the log package) end up here too.
+	slog.SetDefault(slog.New(logger.Handler()))
 
-	displayVersion := flag.Bool("version", false, "Display version and exit")
+	err = cfg.validate()
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
 
-	flag.Parse()
+	applyLogSettings(logger, cfg)
 
-	// Print version number flag
-	if *displayVersion {
-		fmt.Printf("Version:\t%s\n", version)
-		os.Exit(0)
-	}
+	// New password hashes use these, existing ones get upgraded on next login.
+	data.PasswordParams.Memory = uint32(cfg.password.memory)
+	data.PasswordParams.Iterations = uint32(cfg.password.iterations)
+	data.PasswordParams.Parallelism = uint8(cfg.password.parallelism)
+	data.SetHashingBudget(uint64(cfg.password.memoryBudget))
+	data.Policy.MinScore = cfg.password.minScore
 
-	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
+	if cfg.password.breachedFile != "" {
+		breached, err := data.LoadBreachedPasswords(cfg.password.breachedFile)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
 
-	db, err := openDB(cfg)
+		data.Policy.Breached = breached
+
+		logger.PrintInfo("breached password corpus loaded", map[string]any{
+			"file":   cfg.password.breachedFile,
+			"hashes": breached.Len(),
+		})
+	}
+
+	db, err := openDB(*cfg, logger)
 	if err != nil {
 		logger.PrintFatal(err, nil)
 	}
@@ -113,6 +136,94 @@ func main() {
 
 	logger.PrintInfo("database connection pool established", nil)
 
+	app := &application{
+		config:   *cfg,
+		flags:    fs,
+		logger:   logger,
+		db:       data.NewDB(db, nil),
+		registry: metrics.NewRegistry(),
+	}
+
+	app.live.Store(cfg)
+
+	app.clientIPs = cfg.clientIPs
+
+	m := mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username,
+		cfg.smtp.password, cfg.smtp.sender)
+	app.mailer.Store(&m)
+
+	// Subcommands, e.g. `api -db-dsn=... migrate up`.
+	if len(args) > 0 {
+		switch args[0] {
+		case "migrate":
+			err = app.runMigrate(db, args[1:])
+		default:
+			err = fmt.Errorf("unknown command %q", strings.Join(args, " "))
+		}
+
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		return
+	}
+
+	err = checkSchemaVersion(db)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	if cfg.db.replicaDSN != "" {
+		replica, err := newPool(*cfg, cfg.db.replicaDSN)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+
+		defer replica.Close()
+
+		app.db = data.NewDB(db, replica)
+
+		// Reads stay on the primary until the first check passes.
+		go app.db.MonitorReplica(context.Background(), replicaCheckInterval, func(healthy bool, err error) {
+			if healthy {
+				logger.PrintInfo("database replica healthy, serving reads from it", nil)
+			} else {
+				logger.PrintError(err, map[string]any{"database": "replica"})
+			}
+		})
+
+		go app.lastWrites.Cleanup(context.Background(), time.Minute, cfg.db.replicaStickiness)
+
+		expvar.Publish("database_replica", expvar.Func(func() any {
+			return replica.Stats()
+		}))
+	}
+
+	app.models = data.NewModels(app.db)
+
+	switch cfg.limiter.backend {
+	case "postgres":
+		limiter := ratelimit.NewPostgres(db)
+		go limiter.Cleanup(context.Background(), time.Minute, func(err error) {
+			logger.PrintError(err, map[string]any{"limiter": "cleanup"})
+		})
+		app.limiter = limiter
+	default:
+		limiter := ratelimit.NewMemory()
+		go limiter.Cleanup(context.Background(), time.Minute, 3*time.Minute)
+		app.limiter = limiter
+	}
+
+	if cfg.shed.maxInFlight > 0 {
+		app.shedder = newLoadShedder(*cfg)
+	}
+
+	app.tracer, err = newTracer(*cfg, logger)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	app.registerMetrics()
+
 	// Expvar.
 	expvar.NewString("version").Set(version)
 	expvar.Publish("goroutines", expvar.Func(func() any {
@@ -121,52 +232,105 @@ func main() {
 	expvar.Publish("database", expvar.Func(func() any {
 		return db.Stats()
 	}))
+	expvar.Publish("database_pool", expvar.Func(func() any {
+		return poolGauges(db.Stats())
+	}))
 	expvar.Publish("timestamp", expvar.Func(func() any {
 		return time.Now().Unix()
 	}))
 
-	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username,
-			cfg.smtp.password, cfg.smtp.sender),
-	}
-
 	err = app.serve()
 	if err != nil {
 		logger.PrintFatal(err, nil)
 	}
 }
 
-// Returns a sql.DB connection pool.
-func openDB(cfg config) (*sql.DB, error) {
-	// Create empty conn pool.
-	db, err := sql.Open("postgres", cfg.db.dsn)
+// Returns a sql.DB connection pool. Retries the initial ping with exponential
+// backoff, since Postgres may still be starting up when we are.
+func openDB(cfg config, logger *jsonlog.Logger) (*sql.DB, error) {
+	db, err := newPool(cfg, cfg.db.dsn)
 	if err != nil {
 		return nil, err
 	}
 
-	db.SetMaxOpenConns(cfg.db.maxOpenConns)
-	db.SetMaxIdleConns(cfg.db.maxIdleConns)
+	for attempt := 0; ; attempt++ {
+		err = pingDB(db)
+		if err == nil {
+			return db, nil
+		}
+
+		if attempt >= cfg.db.connectRetries {
+			db.Close()
+			return nil, err
+		}
+
+		wait := retryDelay(cfg.db.connectBackoff, cfg.db.connectMaxBackoff, attempt)
 
-	duration, err := time.ParseDuration(cfg.db.maxIdleTime)
+		// Only a warning, we'll have another go.
+		logger.PrintWarn("database not reachable yet", map[string]any{
+			"error":   err,
+			"attempt": attempt + 1,
+			"retry":   wait,
+		})
+
+		time.Sleep(wait)
+	}
+}
+
+// Empty conn pool for dsn, with the -db-* pool settings. Doesn't connect.
+func newPool(cfg config, dsn string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", dsn)
 	if err != nil {
 		return nil, err
 	}
 
-	db.SetConnMaxIdleTime(duration)
+	db.SetMaxOpenConns(cfg.db.maxOpenConns)
+	db.SetMaxIdleConns(cfg.db.maxIdleConns)
+
+	db.SetConnMaxIdleTime(cfg.db.maxIdleTime)
+	db.SetConnMaxLifetime(cfg.db.maxLifetime)
+
+	return db, nil
+}
 
+func pingDB(db *sql.DB) error {
 	// Create ctx with a 5 sec timeout deadline
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	// Establish a new conn to the db passing in ctx. If conn couldn't be established
-	// successfully withing 5 secs, this will return err.
-	err = db.PingContext(ctx)
-	if err != nil {
-		return nil, err
+	// If a conn couldn't be established within 5 secs, this will return err.
+	return db.PingContext(ctx)
+}
+
+// base doubled for every attempt, capped at limit, then jittered down by up to
+// half so a bunch of instances restarting together don't retry in lockstep.
+func retryDelay(base, limit time.Duration, attempt int) time.Duration {
+	delay := limit
+	if attempt < 32 && base<<attempt > 0 && base<<attempt < limit {
+		delay = base << attempt
 	}
 
-	return db, nil
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Point in time pool numbers, in the shape a dashboard wants. db.Stats() has
+// the raw counters under "database".
+func poolGauges(stats sql.DBStats) map[string]any {
+	utilisation := 0.0
+	if stats.MaxOpenConnections > 0 {
+		utilisation = float64(stats.InUse) / float64(stats.MaxOpenConnections)
+	}
+
+	return map[string]any{
+		"open":                 stats.OpenConnections,
+		"in_use":               stats.InUse,
+		"idle":                 stats.Idle,
+		"max_open":             stats.MaxOpenConnections,
+		"utilisation":          utilisation,
+		"wait_count":           stats.WaitCount,
+		"wait_duration_ms":     stats.WaitDuration.Milliseconds(),
+		"max_idle_closed":      stats.MaxIdleClosed,
+		"max_idle_time_closed": stats.MaxIdleTimeClosed,
+		"max_lifetime_closed":  stats.MaxLifetimeClosed,
+	}
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"database/sql"
+	"greenlight/internal/mailer"
+	"greenlight/internal/metrics"
+	"greenlight/internal/ratelimit"
+)
+
+// Registers the metrics read at scrape time. Request durations are recorded by
+// the metrics middleware.
+func (app *application) registerMetrics() {
+	reg := app.registry
+
+	reg.RegisterRuntime()
+
+	reg.Func("greenlight_build_info", "Version of the running binary.", "gauge", []string{"version"},
+		func() []metrics.Sample {
+			return []metrics.Sample{{Labels: []string{version}, Value: 1}}
+		})
+
+	// DB pools, labelled by pool so the replica shows up next to the primary.
+	pools := map[string]*sql.DB{"primary": app.db.DB}
+	if replica := app.db.Replica(); replica != nil {
+		pools["replica"] = replica
+	}
+
+	poolMetric := func(name, help, typ string, fn func(sql.DBStats) float64) {
+		reg.Func(name, help, typ, []string{"pool"}, func() []metrics.Sample {
+			var samples []metrics.Sample
+			for pool, db := range pools {
+				samples = append(samples, metrics.Sample{Labels: []string{pool}, Value: fn(db.Stats())})
+			}
+			return samples
+		})
+	}
+
+	poolMetric("greenlight_db_max_open_connections", "Max open connections allowed.", "gauge",
+		func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) })
+	poolMetric("greenlight_db_open_connections", "Open connections, in use and idle.", "gauge",
+		func(s sql.DBStats) float64 { return float64(s.OpenConnections) })
+	poolMetric("greenlight_db_in_use_connections", "Connections in use.", "gauge",
+		func(s sql.DBStats) float64 { return float64(s.InUse) })
+	poolMetric("greenlight_db_idle_connections", "Idle connections.", "gauge",
+		func(s sql.DBStats) float64 { return float64(s.Idle) })
+	poolMetric("greenlight_db_wait_count_total", "Times we had to wait for a connection.", "counter",
+		func(s sql.DBStats) float64 { return float64(s.WaitCount) })
+	poolMetric("greenlight_db_wait_duration_seconds_total", "Time spent waiting for a connection.", "counter",
+		func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() })
+	poolMetric("greenlight_db_max_idle_closed_total", "Connections closed due to -db-max-idle-conns.", "counter",
+		func(s sql.DBStats) float64 { return float64(s.MaxIdleClosed) })
+	poolMetric("greenlight_db_max_idle_time_closed_total", "Connections closed due to -db-max-idle-time.", "counter",
+		func(s sql.DBStats) float64 { return float64(s.MaxIdleTimeClosed) })
+	poolMetric("greenlight_db_max_lifetime_closed_total", "Connections closed due to -db-max-lifetime.", "counter",
+		func(s sql.DBStats) float64 { return float64(s.MaxLifetimeClosed) })
+
+	// Only the memory backend has a map worth watching, the postgres one is
+	// a table cleaned up on its own.
+	if limiter, ok := app.limiter.(*ratelimit.Memory); ok {
+		reg.GaugeFunc("greenlight_rate_limiter_keys", "Clients tracked by the in memory rate limiter.",
+			func() float64 { return float64(limiter.Len()) })
+	}
+
+	reg.Func("greenlight_mail_sends_total", "Emails sent, by result. Retries count once.", "counter",
+		[]string{"result"}, func() []metrics.Sample {
+			sent, failed := mailer.Counts()
+			return []metrics.Sample{
+				{Labels: []string{"success"}, Value: float64(sent)},
+				{Labels: []string{"failure"}, Value: float64(failed)},
+			}
+		})
+
+	reg.CounterFunc("greenlight_background_jobs_started_total", "Background jobs started.",
+		func() float64 { return float64(app.jobs.started.Load()) })
+	reg.GaugeFunc("greenlight_background_jobs_running", "Background jobs running right now.",
+		func() float64 { return float64(app.jobs.running.Load()) })
+	reg.CounterFunc("greenlight_background_jobs_panics_total", "Background jobs that panicked.",
+		func() float64 { return float64(app.jobs.panics.Load()) })
+}
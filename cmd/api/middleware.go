@@ -1,21 +1,61 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"expvar"
-	"fmt"
 	"greenlight/internal/data"
+	"greenlight/internal/metrics"
+	"greenlight/internal/ratelimit"
+	"greenlight/internal/tracing"
 	"greenlight/internal/validator"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
-
-	"github.com/tomasen/realip"
-	"golang.org/x/time/rate"
 )
 
+var requestIDRX = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// Tags every req with an ID, from X-Request-ID if the client (or a proxy in
+// front of us) sent a sane one, else a new random one. It's sent back in the
+// X-Request-ID header and in error responses, and ends up in the logs.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDRX.MatchString(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set("X-Request-ID", id)
+
+		r = app.contextSetRequestID(r, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+
+	// Never fails on the platforms we run on.
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// Works out the client IP once, from forwarding headers if the req came
+// through a trusted proxy, and stores it in the req ctx.
+func (app *application) resolveClientIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = app.contextSetClientIP(r, app.clientIPs.ClientIP(r))
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (app *application) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Create a deferred func which will always be run in the event of a panic,
@@ -26,8 +66,12 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 			if err := recover(); err != nil {
 				w.Header().Set("Connection", "close")
 				// Normalize into error, and use method which will end up using
-				// our custom Logger at ERROR level, and send client a 500.
-				app.serverErrorResponse(w, r, fmt.Errorf("%s", err))
+				// our custom Logger at ERROR level, and send client a 500. The
+				// error keeps the stack from where it panicked, and goes in a
+				// crash report too.
+				panicErr := newPanicError(err)
+				app.reportPanic(r.Context(), panicErr, r)
+				app.serverErrorResponse(w, r, panicErr)
 			}
 		}()
 
@@ -35,77 +79,106 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
-func (app *application) rateLimit(next http.Handler) http.Handler {
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
-	}
-
-	var (
-		mu      sync.Mutex
-		clients = make(map[string]*client)
-	)
+// Coarse limit per client IP over all routes, -limiter-ip-rps/-limiter-ip-burst.
+// Runs before authenticate, so every token guess counts against it before it
+// costs us a lookup. Routes' tiers in rateLimit apply on top.
+func (app *application) limitByIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := app.liveConfig()
 
-	// Launch a bg goroutine which removes old entries from the clients map
-	// once every minute
-	go func() {
-		for {
-			time.Sleep(time.Minute)
+		if !cfg.limiter.enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
 
-			// Lock mutex to prevent any rate limiter checks from happening while
-			// the cleanup is taking place
-			mu.Lock()
+		limit := ratelimit.Limit{Rate: cfg.limiter.ipRPS, Burst: cfg.limiter.ipBurst}
 
-			// Loop through all clients. If not seen in last 3 mins, remove.
-			for ip, client := range clients {
-				if time.Since(client.lastSeen) > 3*time.Minute {
-					delete(clients, ip)
-				}
-			}
+		result, err := app.limiter.Allow(r.Context(), "global:ip:"+app.contextGetClientIP(r), limit, 1)
+		if err != nil {
+			// Same as rateLimit, fail open.
+			app.logError(r, err)
+			next.ServeHTTP(w, r)
+			return
+		}
 
-			// Unlock mutex when cleanup is done
-			mu.Unlock()
+		// Headers only on a 429 here, reqs let through get the route tier's
+		// from rateLimit.
+		if !result.Allowed {
+			setRateLimitHeaders(w, limit, result)
+			app.rateLimitExceededResponse(w, r, result.RetryAfter)
+			return
 		}
-	}()
 
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Limits reqs to a route by its tier (see defaultRouteLimits). Authenticated
+// users get their own bucket per tier wherever they connect from, anyone else
+// shares one with their IP. Admins aren't limited.
+func (app *application) rateLimit(route string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if app.config.limiter.enabled {
-			// Extract client's IP addr from req.
-			ip := realip.FromRequest(r)
-
-			// Lock to prevent this code from being executed concurrently.
-			mu.Lock()
-
-			// Check to see if IP address already exists in map.
-			if _, found := clients[ip]; !found {
-				// Create and add a new client struct to map if doesn't already exist.
-				clients[ip] = &client{
-					limiter: rate.NewLimiter(rate.Limit(app.config.limiter.rps),
-						app.config.limiter.burst),
-				}
-			}
+		// Limits can change on SIGHUP, so look them up on every req.
+		cfg := app.liveConfig()
 
-			// Update the last seen time for client.
-			clients[ip].lastSeen = time.Now()
+		if !cfg.limiter.enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
 
-			// When we call Allow(), one token will be consumed from bucket.
-			// Concurrency safe
-			if !clients[ip].limiter.Allow() {
-				mu.Unlock()
-				app.rateLimitExceededResponse(w, r)
+		key := "ip:" + app.contextGetClientIP(r)
+
+		user := app.contextGetUser(r)
+		if !user.IsAnonymous() {
+			permissions, err := app.permissionsFor(r)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			if permissions.Include("admin") {
+				next.ServeHTTP(w, r)
 				return
 			}
 
-			// Unlock the mutex before calling next handler. DON'T DEFER THIS.
-			// That would mean that mutex isnt unlocked until all the handlers downstream
-			// from this middleware also returned.
-			mu.Unlock()
+			key = "user:" + strconv.FormatInt(user.ID, 10)
+		}
+
+		// Tiers are validated at startup and on reload.
+		rl, limit, _ := cfg.routeLimit(route)
 
+		result, err := app.limiter.Allow(r.Context(), rl.tier+":"+key, limit, rl.cost)
+		if err != nil {
+			// Better to let reqs through than fail every one of them while
+			// the limiter's backend is down.
+			app.logError(r, err)
+			next.ServeHTTP(w, r)
+			return
 		}
+
+		setRateLimitHeaders(w, limit, result)
+
+		if !result.Allowed {
+			app.rateLimitExceededResponse(w, r, result.RetryAfter)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
 
+// RateLimit-* headers describing the bucket a req was checked against.
+func setRateLimitHeaders(w http.ResponseWriter, limit ratelimit.Limit, result ratelimit.Result) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.ResetAfter)))
+}
+
+// Whole seconds for headers, rounded up so clients don't come back early.
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Indicate to any caches that the response may vary based on value of
@@ -115,6 +188,39 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// Get value of the Authorization header from the req.
 		authorizationHeader := r.Header.Get("Authorization")
 
+		// No auth header but a verified client cert (mTLS), so the cert is the
+		// credential. Unverified certs never make it into VerifiedChains. Only
+		// the service accounts in -tls-client-accounts can log in this way, any
+		// cert from the CA could otherwise claim to be e.g. an admin.
+		if authorizationHeader == "" && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			identity := clientCertIdentity(r.TLS.VerifiedChains[0][0])
+
+			if !app.isServiceAccount(identity) {
+				app.unknownClientCertificateResponse(w, r)
+				return
+			}
+
+			user, err := app.models.Users.GetByEmail(r.Context(), identity)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecordNotFound):
+					app.unknownClientCertificateResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+
+			if !user.Activated {
+				app.unknownClientCertificateResponse(w, r)
+				return
+			}
+
+			r = app.contextSetUser(r, user)
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		// If no auth header, add anon user to req ctx. Then call next handler in
 		// chain and not run anything else below here.
 		if authorizationHeader == "" {
@@ -142,7 +248,7 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		}
 
 		// Get user associated with token. (Remember to use scopeAuthentication)
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, err := app.models.Users.GetForToken(r.Context(), data.ScopeAuthentication, token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -161,6 +267,87 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 	})
 }
 
+// When each user last wrote, for stickyReads. The zero value is ready to use.
+type lastWrites struct {
+	mu    sync.Mutex
+	times map[int64]time.Time
+}
+
+func (lw *lastWrites) record(userID int64) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	if lw.times == nil {
+		lw.times = make(map[int64]time.Time)
+	}
+	lw.times[userID] = time.Now()
+}
+
+// Whether userID wrote less than window ago.
+func (lw *lastWrites) within(userID int64, window time.Duration) bool {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	lastWrite, found := lw.times[userID]
+	return found && time.Since(lastWrite) < window
+}
+
+// Forgets users who last wrote over maxAge ago, every interval until ctx is
+// done.
+func (lw *lastWrites) Cleanup(ctx context.Context, interval, maxAge time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			lw.mu.Lock()
+			for id, lastWrite := range lw.times {
+				if time.Since(lastWrite) > maxAge {
+					delete(lw.times, id)
+				}
+			}
+			lw.mu.Unlock()
+		}
+	}
+}
+
+// Read-your-writes for the replica. Anything that might write reads from the
+// primary too, and so does the same user for -db-replica-stickiness after, so
+// they don't get stale data back straight after changing something.
+func (app *application) stickyReads(next http.Handler) http.Handler {
+	if app.db.Replica() == nil {
+		return next
+	}
+
+	stickiness := app.config.db.replicaStickiness
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		write := r.Method != http.MethodGet && r.Method != http.MethodHead &&
+			r.Method != http.MethodOptions
+
+		primary := write
+		if !write && !user.IsAnonymous() {
+			primary = app.lastWrites.within(user.ID, stickiness)
+		}
+
+		if primary {
+			r = r.WithContext(data.WithPrimary(r.Context()))
+		}
+
+		next.ServeHTTP(w, r)
+
+		// Start the window once the write is done.
+		if write && !user.IsAnonymous() {
+			app.lastWrites.record(user.ID)
+		}
+	})
+}
+
 // Different signature - so we can wrap handler funcs directly with this middleware.
 
 // Checks if user is not anon.
@@ -195,25 +382,36 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 }
 
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	return app.requireAnyPermission([]string{code}, next)
+}
+
+// Like requirePermission, but lets the user through if they hold any of codes.
+func (app *application) requireAnyPermission(codes []string, next http.HandlerFunc) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		// Retrieve user from current ctx.
-		user := app.contextGetUser(r)
+		// Get the slice of permissions for the user, usually already loaded
+		// by rateLimit.
+		ctx, span := tracing.Start(r.Context(), "requirePermission", tracing.KindInternal)
+		span.SetAttribute("permissions.required", strings.Join(codes, " "))
+
+		permissions, err := app.permissionsFor(r.WithContext(ctx))
+		span.RecordError(err)
+		span.End()
 
-		// Get the slice of permissions for user.
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
 		}
 
-		// Check if the slice includes the required perm. If not, 403.
-		if !permissions.Include(code) {
-			app.notPermittedResponse(w, r)
-			return
+		// Check if the slice includes any of the required perms. If not, 403.
+		for _, code := range codes {
+			if permissions.Include(code) {
+				// Check successful, call next handler in the chain.
+				next.ServeHTTP(w, r)
+				return
+			}
 		}
 
-		// Check successful, call next handler in the chain.
-		next.ServeHTTP(w, r)
+		app.notPermittedResponse(w, r)
 	}
 
 	return app.requireActivatedUser(fn)
@@ -230,8 +428,10 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 
 		// Only run this if there's an origin
 		if origin != "" {
-			for i := range app.config.cors.trustedOrigins {
-				if origin == app.config.cors.trustedOrigins[i] {
+			trustedOrigins := app.liveConfig().cors.trustedOrigins
+
+			for i := range trustedOrigins {
+				if origin == trustedOrigins[i] {
 					w.Header().Set("Access-Control-Allow-Origin", origin)
 
 					// Check if it's a preflight request.
@@ -260,6 +460,7 @@ type metricsResponseWriter struct {
 	wrapped       http.ResponseWriter
 	statusCode    int
 	headerWritten bool
+	bytesWritten  int
 }
 
 func (mw *metricsResponseWriter) Header() http.Header {
@@ -281,13 +482,27 @@ func (mw *metricsResponseWriter) Write(b []byte) (int, error) {
 		mw.headerWritten = true
 	}
 
-	return mw.wrapped.Write(b)
+	n, err := mw.wrapped.Write(b)
+	mw.bytesWritten += n
+
+	return n, err
 }
 
 func (mw *metricsResponseWriter) Unwrap() http.ResponseWriter {
 	return mw.wrapped
 }
 
+// Wraps w once for everything that wants the status and size of the response,
+// e.g. accessLog. They read them from the req's requestInfo once next returns.
+func (app *application) recordResponse(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, info := app.requestInfoFor(r)
+
+		info.response = &metricsResponseWriter{wrapped: w}
+		next.ServeHTTP(info.response, r)
+	})
+}
+
 func (app *application) metrics(next http.Handler) http.Handler {
 	// Init new expvar vars when the middleware chain is first built.
 	var (
@@ -297,6 +512,11 @@ func (app *application) metrics(next http.Handler) http.Handler {
 		totalResponsesSentByStatus      = expvar.NewMap("total_responses_sent_by_status")
 	)
 
+	// Same for /metrics. Labelled by route pattern rather than path, so
+	// /v1/movies/1 and /v1/movies/2 share a series.
+	requestDuration := app.registry.Histogram("greenlight_http_request_duration_seconds",
+		"Time taken to serve requests.", metrics.DefBuckets, "route", "method", "status")
+
 	// For every request...
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Starting to process the request.
@@ -305,19 +525,39 @@ func (app *application) metrics(next http.Handler) http.Handler {
 		// Incr num of reqs by 1.
 		totalRequestsReceived.Add(1)
 
-		mw := &metricsResponseWriter{wrapped: w}
-
-		// Call next handler in chain using the new metricsResponseWriter
-		next.ServeHTTP(mw, r)
+		// Call next handler in chain, recordResponse has wrapped w already.
+		next.ServeHTTP(w, r)
 
 		// On the way back up the middleware chain, increment number of responses.
 		totalResponsesSent.Add(1)
 
-		// At this point, the res status code should be stored in mw.statusCode field.
-		totalResponsesSentByStatus.Add(strconv.Itoa(mw.statusCode), 1)
+		// At this point, the res status code is stored in the req's requestInfo.
+		info := app.contextGetRequestInfo(r)
+		status := info.status()
+		totalResponsesSentByStatus.Add(strconv.Itoa(status), 1)
 
 		// Get time since we began to process the request.
-		duration := time.Since(start).Microseconds()
-		totalProcessingTimeMicroseconds.Add(duration)
+		duration := time.Since(start)
+		totalProcessingTimeMicroseconds.Add(duration.Microseconds())
+
+		// 404s and the like never matched a route. Don't label them by path,
+		// anyone could make up new ones.
+		route := info.route
+		if route == "" {
+			route = "unmatched"
+		}
+
+		requestDuration.Observe(duration.Seconds(), route, metricsMethod(r.Method), strconv.Itoa(status))
 	})
 }
+
+// Same idea for methods, clients can send any token as one.
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"greenlight/internal/migrate"
+	"greenlight/migrations"
+	"strconv"
+	"time"
+)
+
+const migrateUsage = "usage: api migrate up|down [N]|status|goto N"
+
+// Handles `api migrate ...`. Runs against the database from -db-dsn.
+func (app *application) runMigrate(db *sql.DB, args []string) error {
+	mg, err := migrate.New(db, migrations.FS)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	// Migrations can take a while, but shouldn't hang forever.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	var ran []migrate.Migration
+
+	switch args[0] {
+	case "up":
+		ran, err = mg.Up(ctx)
+
+	case "down":
+		n := 1
+		if len(args) > 1 {
+			n, err = strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return errors.New(migrateUsage)
+			}
+		}
+		ran, err = mg.Down(ctx, n)
+
+	case "goto":
+		if len(args) < 2 {
+			return errors.New(migrateUsage)
+		}
+
+		var target int64
+		target, err = strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return errors.New(migrateUsage)
+		}
+		ran, err = mg.Goto(ctx, target)
+
+	case "status":
+		statuses, err := mg.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range statuses {
+			state := "pending"
+			if s.Applied {
+				state = "applied"
+			}
+			fmt.Printf("%06d\t%-8s\t%s\n", s.Version, state, s.Name)
+		}
+		return nil
+
+	default:
+		return errors.New(migrateUsage)
+	}
+
+	// Log whatever did run, even if a later migration failed.
+	for _, m := range ran {
+		app.logger.PrintInfo("applied migration", map[string]any{
+			"version":   m.Version,
+			"name":      m.Name,
+			"direction": args[0],
+		})
+	}
+
+	if err != nil {
+		return err
+	}
+
+	version, _, err := mg.Version(ctx)
+	if err != nil {
+		return err
+	}
+
+	app.logger.PrintInfo("database schema is at version "+strconv.FormatInt(version, 10), nil)
+
+	return nil
+}
+
+// Refuse to start against a schema older than the one this binary was built
+// for. A newer schema is fine, that's what a rollback of the binary looks like.
+func checkSchemaVersion(db *sql.DB) error {
+	mg, err := migrate.New(db, migrations.FS)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	version, dirty, err := mg.Version(ctx)
+	if err != nil {
+		return err
+	}
+
+	if dirty {
+		return fmt.Errorf("database schema is dirty at version %d", version)
+	}
+
+	if version < mg.Latest() {
+		return fmt.Errorf("database schema is at version %d but this binary needs %d, run `api migrate up`",
+			version, mg.Latest())
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"greenlight/internal/jsonlog"
+	"greenlight/internal/mailer"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// The config currently in effect, including any SIGHUP reloads.
+func (app *application) liveConfig() *config {
+	return app.live.Load()
+}
+
+// Re-reads config from the same file, env and flags we started with, and
+// swaps in the settings that are safe to change at runtime: rate limits, CORS
+// origins, log level/stack traces/redaction, access log sampling and mail
+// settings. Everything else needs a restart. If the new config doesn't
+// validate we keep the old one.
+func (app *application) reloadConfig() error {
+	next, _, err := loadConfig(app.config.args)
+	if err != nil {
+		return err
+	}
+
+	err = next.validate()
+	if err != nil {
+		return err
+	}
+
+	current := app.liveConfig()
+
+	updated := *current
+	updated.logLevel = next.logLevel
+	updated.logStackLevel = next.logStackLevel
+	updated.logRedactKeys = next.logRedactKeys
+	updated.accessLog = next.accessLog
+	updated.accessLog.enabled = current.accessLog.enabled // Needs a restart.
+	updated.limiter = next.limiter
+	updated.limiter.backend = current.limiter.backend // Needs a restart.
+	updated.cors = next.cors
+	updated.smtp = next.smtp
+
+	before := reloadableSettings(current)
+	after := reloadableSettings(&updated)
+
+	var changed []string
+	for key := range after {
+		if before[key] != after[key] {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+
+	if len(changed) == 0 {
+		app.logger.PrintInfo("config reloaded, nothing changed", nil)
+		return nil
+	}
+
+	applyLogSettings(app.logger, &updated)
+
+	if updated.smtp != current.smtp {
+		m := mailer.New(updated.smtp.host, updated.smtp.port, updated.smtp.username,
+			updated.smtp.password, updated.smtp.sender)
+		app.mailer.Store(&m)
+	}
+
+	app.live.Store(&updated)
+
+	properties := make(map[string]any, len(changed))
+	for _, key := range changed {
+		// Still want to know secrets changed, just not to what.
+		if slices.Contains(secretFlags, key) {
+			properties[key] = "[redacted]"
+			continue
+		}
+		properties[key] = map[string]any{"from": before[key], "to": after[key]}
+	}
+
+	app.logger.PrintInfo("config reloaded", properties)
+
+	return nil
+}
+
+// Level, stack traces and redaction. At startup and again on every reload.
+func applyLogSettings(logger *jsonlog.Logger, cfg *config) {
+	logger.SetLevel(jsonlog.Level(cfg.logLevel))
+	logger.SetStackLevel(jsonlog.Level(cfg.logStackLevel))
+	logger.SetRedactKeys(cfg.logRedactKeys...)
+}
+
+// Flag name -> value for everything reloadConfig can change.
+func reloadableSettings(cfg *config) map[string]string {
+	settings := map[string]string{
+		"log-level":                 cfg.logLevel.String(),
+		"log-stack-level":           cfg.logStackLevel.String(),
+		"log-redact-keys":           cfg.logRedactKeys.String(),
+		"access-log-sample-rate":    fmt.Sprint(cfg.accessLog.sampleRate),
+		"access-log-exclude-health": fmt.Sprint(cfg.accessLog.excludeHealth),
+		"limiter-rps":               fmt.Sprint(cfg.limiter.rps),
+		"limiter-burst":             fmt.Sprint(cfg.limiter.burst),
+		"limiter-ip-rps":            fmt.Sprint(cfg.limiter.ipRPS),
+		"limiter-ip-burst":          fmt.Sprint(cfg.limiter.ipBurst),
+		"limiter-enabled":           fmt.Sprint(cfg.limiter.enabled),
+		"limiter-tiers":             cfg.limiter.tiers.String(),
+		"limiter-routes":            cfg.limiter.routes.String(),
+		"cors-trusted-origins":      strings.Join(cfg.cors.trustedOrigins, " "),
+		"smtp-host":                 cfg.smtp.host,
+		"smtp-port":                 fmt.Sprint(cfg.smtp.port),
+		"smtp-sender":               cfg.smtp.sender,
+		"smtp-username":             cfg.smtp.username,
+		"smtp-password":             cfg.smtp.password,
+	}
+
+	return settings
+}
@@ -1,44 +1,116 @@
 package main
 
 import (
-	"expvar"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
 )
 
+// Rate limit tier for the limiter to use with the -limiter-rps/-limiter-burst.
+const defaultTier = "default"
+
+// Routes that don't use the default tier at cost 1. Tiers are set with
+// -limiter-tiers and this can be overridden with -limiter-routes.
+var defaultRouteLimits = routeLimits{
+	// Stop password guessing and mail bombing.
+	routeKey(http.MethodPost, "/v1/tokens/authentication"): {tier: "auth", cost: 1},
+	routeKey(http.MethodPost, "/v1/tokens/activation"):     {tier: "auth", cost: 1},
+	routeKey(http.MethodPost, "/v1/users"):                 {tier: "auth", cost: 1},
+
+	routeKey(http.MethodGet, "/v1/movies"):     {tier: "read", cost: 1},
+	routeKey(http.MethodGet, "/v1/movies/:id"): {tier: "read", cost: 1},
+
+	// Load balancer probes.
+	routeKey(http.MethodGet, "/v1/healthz/live"):  {tier: "read", cost: 1},
+	routeKey(http.MethodGet, "/v1/healthz/ready"): {tier: "read", cost: 1},
+}
+
+func routeKey(method, pattern string) string {
+	return method + " " + pattern
+}
+
 func (app *application) routes() http.Handler {
 	// Initialise new instance of httprouter.
 	router := httprouter.New()
 
 	// Convert our notFoundResponse helper to a Handler using adapter, and set
-	// it as the custom error handler for 404 not found responses.
-	router.NotFound = http.HandlerFunc(app.notFoundResponse)
+	// it as the custom error handler for 404 not found responses. Rate limited
+	// too, so probing for routes isn't free.
+	router.NotFound = app.rateLimit("", http.HandlerFunc(app.notFoundResponse))
 
 	//Same for methodNotAllowed
-	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
+	router.MethodNotAllowed = app.rateLimit("", http.HandlerFunc(app.methodNotAllowedResponse))
+
+	// Registers a route behind its rate limit, see defaultRouteLimits.
+	handle := func(method, pattern string, handler http.HandlerFunc) {
+		router.Handler(method, pattern, app.matchedRoute(pattern, app.traced("rateLimit",
+			app.rateLimit(routeKey(method, pattern), app.traced("handler", handler)))))
+	}
 
-	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	handle(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	handle(http.MethodGet, "/v1/healthz/live", app.livenessHandler)
+	handle(http.MethodGet, "/v1/healthz/ready", app.readinessHandler)
 
-	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermission(
+	handle(http.MethodGet, "/v1/movies", app.requirePermission(
 		"movies:read", app.listMoviesHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission(
-		"movies:write", app.createMovieHandler))
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermission(
+	// movies:write:own only allows changing movies the user created, which
+	// the handlers check themselves.
+	movieWriters := []string{"movies:write", "movies:write:own"}
+
+	handle(http.MethodPost, "/v1/movies", app.requireAnyPermission(
+		movieWriters, app.createMovieHandler))
+	handle(http.MethodGet, "/v1/movies/:id", app.requirePermission(
 		"movies:read", app.showMovieHandler))
-	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission(
-		"movies:write", app.updateMovieHandler))
-	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission(
-		"movies:write", app.deleteMovieHandler))
+	handle(http.MethodPatch, "/v1/movies/:id", app.requireAnyPermission(
+		movieWriters, app.updateMovieHandler))
+	handle(http.MethodDelete, "/v1/movies/:id", app.requireAnyPermission(
+		movieWriters, app.deleteMovieHandler))
+	handle(http.MethodPut, "/v1/movies/:id/owner", app.requirePermission(
+		"admin", app.transferMovieHandler))
+
+	// Can't live under /v1/movies, httprouter won't mix :id with static segments.
+	handle(http.MethodGet, "/v1/submissions", app.requirePermission(
+		"movies:approve", app.listSubmissionsHandler))
+	handle(http.MethodPost, "/v1/submissions", app.requirePermission(
+		"movies:read", app.createSubmissionHandler))
+	handle(http.MethodGet, "/v1/submissions/:id", app.requirePermission(
+		"movies:read", app.showSubmissionHandler))
+	handle(http.MethodPut, "/v1/submissions/:id/approve", app.requirePermission(
+		"movies:approve", app.approveSubmissionHandler))
+	handle(http.MethodPut, "/v1/submissions/:id/reject", app.requirePermission(
+		"movies:approve", app.rejectSubmissionHandler))
+
+	handle(http.MethodPost, "/v1/users", app.registerUserHandler)
+	handle(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
 
-	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
-	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	handle(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
+	handle(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
 
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	// Middlewares, outermost first. When tracing each one gets a span, nested
+	// in the req's root span from trace.
+	// Rate limiting happens per IP before authenticate, so bogus tokens can't
+	// be tried at will, then per route after it so tiers can key on the user.
+	// Writes with credentials are shed after authenticate too, see shedLoad.
+	middleware := []struct {
+		name string
+		wrap func(http.Handler) http.Handler
+	}{
+		{"resolveClientIP", app.resolveClientIP},
+		{"accessLog", app.accessLog},
+		{"metrics", app.metrics},
+		{"recoverPanic", app.recoverPanic},
+		{"shedLoad", app.shedLoad},
+		{"enableCORS", app.enableCORS},
+		{"limitByIP", app.limitByIP},
+		{"authenticate", app.authenticate},
+		{"shedAuthenticated", app.shedAuthenticated},
+		{"stickyReads", app.stickyReads},
+	}
 
-	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
+	var handler http.Handler = router
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = app.traced(middleware[i].name, middleware[i].wrap(handler))
+	}
 
-	// Middlewares.
-	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
+	return app.requestID(app.recordResponse(app.trace(handler)))
 }
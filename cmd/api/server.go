@@ -4,10 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"greenlight/internal/systemd"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -26,6 +30,38 @@ func (app *application) serve() error {
 		WriteTimeout: 30 * time.Second,
 	}
 
+	listeners, err := app.listen(srv.Addr)
+	if err != nil {
+		return err
+	}
+
+	if app.config.tls.cert != "" {
+		certs, err := newCertReloader(app.config.tls.cert, app.config.tls.key)
+		if err != nil {
+			return err
+		}
+
+		srv.TLSConfig, err = newTLSConfig(app.config, certs)
+		if err != nil {
+			return err
+		}
+
+		done := make(chan struct{})
+		defer close(done)
+		go app.watchCertificate(certs, done)
+	}
+
+	adminSrv, adminLn, err := app.adminServer()
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, ln := range listeners {
+		names = append(names, ln.Addr().Network()+":"+ln.Addr().String())
+	}
+	addrs := strings.Join(names, " ")
+
 	// Use this chan to receive any errors returned by graceful Shutdown()
 	shutdownError := make(chan error)
 
@@ -41,10 +77,18 @@ func (app *application) serve() error {
 		// is received.
 		s := <-quit
 
-		app.logger.PrintInfo("shutting down server", map[string]string{
+		app.logger.PrintInfo("shutting down server", map[string]any{
 			"signal": s.String(),
 		})
 
+		app.notifySystemd("STOPPING=1")
+
+		// Fail readiness first and give load balancers a moment to notice,
+		// before we stop taking new connections.
+		app.shuttingDown.Store(true)
+
+		time.Sleep(app.config.shutdownDelay)
+
 		// New context with a 20 sec timeout
 		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 		defer cancel()
@@ -56,22 +100,91 @@ func (app *application) serve() error {
 
 		// Log a message to say that we're waiting for any background goroutines to
 		// complete their tasks.
-		app.logger.PrintInfo("completing background tasks", map[string]string{
-			"addr": srv.Addr,
+		app.logger.PrintInfo("completing background tasks", map[string]any{
+			"addr": addrs,
 		})
 
 		// This blocks until all our goroutines have finished.
 		app.wg.Wait()
+
+		// Kept up until now, so we can still look at a slow drain.
+		if adminSrv != nil {
+			err = adminSrv.Shutdown(ctx)
+			if err != nil {
+				app.logger.PrintError(err, map[string]any{"admin": adminLn.Addr().String()})
+			}
+		}
+
+		// Their spans included, so flush traces last.
+		if app.tracer != nil {
+			err = app.tracer.Shutdown(ctx)
+			if err != nil {
+				app.logger.PrintError(err, map[string]any{"tracing": "shutdown"})
+			}
+		}
 		// Shutdown completed with no issues.
 		shutdownError <- nil
 	}()
 
-	app.logger.PrintInfo("starting server", map[string]string{
-		"addr": srv.Addr,
+	// SIGHUP reloads the runtime settings, see reloadConfig(). Registered
+	// here rather than in the goroutine, so once systemd hears READY=1 a
+	// reload can't kill us with the default SIGHUP action.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			app.notifySystemd("RELOADING=1")
+			err := app.reloadConfig()
+			if err != nil {
+				app.logger.PrintError(err, map[string]any{
+					"signal": syscall.SIGHUP.String(),
+				})
+			}
+			app.notifySystemd("READY=1")
+		}
+	}()
+
+	// One goroutine per listener. They all return ErrServerClosed once
+	// Shutdown() is called, so the first result is all we need.
+	serveErrors := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			if srv.TLSConfig != nil {
+				// Certs come from TLSConfig.GetCertificate.
+				serveErrors <- srv.ServeTLS(ln, "", "")
+			} else {
+				serveErrors <- srv.Serve(ln)
+			}
+		}(ln)
+	}
+
+	if adminSrv != nil {
+		go func() {
+			err := adminSrv.Serve(adminLn)
+			if !errors.Is(err, http.ErrServerClosed) {
+				app.logger.PrintError(err, map[string]any{"admin": adminLn.Addr().String()})
+			}
+		}()
+	}
+
+	properties := map[string]any{
+		"addr": addrs,
 		"env":  app.config.env,
-	})
+	}
+	if adminSrv != nil {
+		properties["admin"] = adminLn.Addr().Network() + ":" + adminLn.Addr().String()
+	}
+	if srv.TLSConfig != nil {
+		properties["tls"] = app.config.tls.minVersion + "+"
+		properties["mtls"] = app.config.tls.clientCA != ""
+	}
+	app.logger.PrintInfo("starting server", properties)
+
+	// Let systemd know we're actually up, not just started.
+	app.notifySystemd("READY=1")
 
-	err := srv.ListenAndServe()
+	err = <-serveErrors
 	// If we get this err, indication that graceful shutdown has started - Good.
 	if !errors.Is(err, http.ErrServerClosed) {
 		return err
@@ -84,9 +197,77 @@ func (app *application) serve() error {
 	}
 
 	// At this point, graceful shutdown successful.
-	app.logger.PrintInfo("stopped server", map[string]string{
-		"addr": srv.Addr,
+	app.logger.PrintInfo("stopped server", map[string]any{
+		"addr": addrs,
 	})
 
 	return nil
 }
+
+// Picks what to listen on: sockets handed over by systemd socket activation
+// first, then -unix-socket, then plain TCP on addr. With socket activation the
+// socket outlives us, so connections just queue up while we restart.
+func (app *application) listen(addr string) ([]net.Listener, error) {
+	listeners, err := systemd.Listeners()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(listeners) > 0 {
+		return listeners, nil
+	}
+
+	if app.config.unixSocket.path == "" {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+	}
+
+	ln, err := listenUnix(app.config.unixSocket.path, fs.FileMode(app.config.unixSocket.mode))
+	if err != nil {
+		return nil, err
+	}
+
+	return []net.Listener{ln}, nil
+}
+
+// Listens on the Unix socket at path with the given permissions.
+func listenUnix(path string, mode fs.FileMode) (net.Listener, error) {
+	// Clear out a socket left behind by a crash, but never anything else.
+	info, err := os.Lstat(path)
+	if err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+
+		err = os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(path, mode)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return ln, nil
+}
+
+// Failing to notify systemd isn't worth stopping for, just log it.
+func (app *application) notifySystemd(state string) {
+	err := systemd.Notify(state)
+	if err != nil {
+		app.logger.PrintError(err, map[string]any{
+			"sd_notify": state,
+		})
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"greenlight/internal/data"
+	"greenlight/internal/validator"
+	"net/http"
+	"time"
+)
+
+// Lets users with only movies:read propose a new movie, or an edit to an
+// existing one when movie_id is given. Nothing touches the catalogue until a
+// reviewer approves it.
+func (app *application) createSubmissionHandler(w http.ResponseWriter, r *http.Request) {
+	// Pointers so edits can be partial, like the PATCH endpoint.
+	var input struct {
+		MovieID *int64        `json:"movie_id"`
+		Title   *string       `json:"title"`
+		Year    *int32        `json:"year"`
+		Runtime *data.Runtime `json:"runtime"`
+		Genres  []string      `json:"genres"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	// Start from the current movie for edits, or from scratch for new ones.
+	movie := &data.Movie{}
+
+	if input.MovieID != nil {
+		movie, err = app.models.Movies.Get(r.Context(), *input.MovieID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				v.AddError("movie_id", "no matching movie found")
+				app.failedValidationResponse(w, r, v.Errors)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	if input.Title != nil {
+		movie.Title = *input.Title
+	}
+
+	if input.Year != nil {
+		movie.Year = *input.Year
+	}
+
+	if input.Runtime != nil {
+		movie.Runtime = *input.Runtime
+	}
+
+	if input.Genres != nil {
+		movie.Genres = input.Genres
+	}
+
+	if data.ValidateMovie(v, movie); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	submission := &data.MovieSubmission{
+		SubmitterID:  app.contextGetUser(r).ID,
+		MovieID:      movie.ID,
+		MovieVersion: movie.Version,
+		Title:        movie.Title,
+		Year:         movie.Year,
+		Runtime:      movie.Runtime,
+		Genres:       movie.Genres,
+	}
+
+	err = app.models.Submissions.Insert(r.Context(), submission)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/submissions/%d", submission.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"submission": submission}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Submitters can see their own submissions, reviewers can see all of them.
+func (app *application) showSubmissionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	submission, err := app.models.Submissions.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	if submission.SubmitterID != user.ID {
+		permissions, err := app.permissionsFor(r)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// Pretend it doesn't exist rather than leaking other users' submissions.
+		if !permissions.Include("movies:approve") {
+			app.notFoundResponse(w, r)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"submission": submission}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The review queue. Defaults to pending submissions, oldest first.
+func (app *application) listSubmissionsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Status string
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Status = app.readString(qs, "status", data.SubmissionPending)
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "created_at")
+	input.Filters.SortSafeList = []string{"id", "created_at", "title", "-id", "-created_at", "-title"}
+
+	v.Check(validator.PermittedValue(input.Status, "all", data.SubmissionPending,
+		data.SubmissionApproved, data.SubmissionRejected), "status", "invalid status value")
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if input.Status == "all" {
+		input.Status = ""
+	}
+
+	submissions, metadata, err := app.models.Submissions.GetAll(r.Context(), input.Status, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"submissions": submissions, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) approveSubmissionHandler(w http.ResponseWriter, r *http.Request) {
+	app.reviewSubmission(w, r, data.SubmissionApproved)
+}
+
+func (app *application) rejectSubmissionHandler(w http.ResponseWriter, r *http.Request) {
+	app.reviewSubmission(w, r, data.SubmissionRejected)
+}
+
+// Shared logic for approving and rejecting. Approving writes the change
+// through the normal MovieModel Insert/Update, in the same transaction as the
+// review. Either way the submitter gets an email.
+func (app *application) reviewSubmission(w http.ResponseWriter, r *http.Request, status string) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Comment string `json:"comment"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	// Rejections have to say why.
+	if status == data.SubmissionRejected {
+		v.Check(input.Comment != "", "comment", "must be provided")
+	}
+	v.Check(len(input.Comment) <= 2000, "comment", "must not be more than 2000 bytes long")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	submission, err := app.models.Submissions.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if submission.Status != data.SubmissionPending {
+		v.AddError("status", "submission has already been reviewed")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	now := time.Now()
+	submission.Status = status
+	submission.ReviewerID = app.contextGetUser(r).ID
+	submission.Comment = input.Comment
+	submission.ReviewedAt = &now
+
+	// The version check on the submission means only one reviewer gets to
+	// decide on it. Approving changes the movie and the submission together or
+	// not at all.
+	if status == data.SubmissionApproved {
+		err = app.db.InTx(r.Context(), func(ctx context.Context) error {
+			err := app.applySubmission(ctx, submission)
+			if err != nil {
+				return err
+			}
+
+			return app.models.Submissions.Update(ctx, submission)
+		})
+	} else {
+		err = app.models.Submissions.Update(r.Context(), submission)
+	}
+
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			// Deleting the movie takes its submissions with it.
+			app.notFoundResponse(w, r)
+		case errors.Is(err, errMovieChanged):
+			v.AddError("movie_id", "movie has been edited since this was submitted")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.background(r.Context(), func(ctx context.Context) {
+		submitter, err := app.models.Users.Get(ctx, submission.SubmitterID)
+		if err != nil {
+			app.loggerFor(ctx).PrintError(err, nil)
+			return
+		}
+
+		tmpl := "submission_rejected.tmpl"
+		if submission.Status == data.SubmissionApproved {
+			tmpl = "submission_approved.tmpl"
+		}
+
+		data := map[string]any{
+			"title":   submission.Title,
+			"movieID": submission.MovieID,
+			"comment": submission.Comment,
+		}
+
+		err = app.sendMail(ctx, submitter.Email, tmpl, data)
+		if err != nil {
+			app.loggerFor(ctx).PrintError(err, nil)
+		}
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"submission": submission}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Approving an edit to a movie that's changed since would silently undo those
+// changes. The submitter has to propose it again against the current movie.
+var errMovieChanged = errors.New("movie changed since submission")
+
+// Writes an approved submission to the movies table, setting MovieID on the
+// submission for new movies.
+func (app *application) applySubmission(ctx context.Context, submission *data.MovieSubmission) error {
+	proposed := submission.Movie()
+
+	if submission.MovieID == 0 {
+		err := app.models.Movies.Insert(ctx, proposed)
+		if err != nil {
+			return err
+		}
+
+		submission.MovieID = proposed.ID
+		return nil
+	}
+
+	movie, err := app.models.Movies.Get(ctx, submission.MovieID)
+	if err != nil {
+		return err
+	}
+
+	if movie.Version != submission.MovieVersion {
+		return errMovieChanged
+	}
+
+	// Ownership stays with whoever owns the movie now.
+	movie.Title = proposed.Title
+	movie.Year = proposed.Year
+	movie.Runtime = proposed.Runtime
+	movie.Genres = proposed.Genres
+
+	return app.models.Movies.Update(ctx, movie)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often we check the cert/key files for changes.
+const certCheckInterval = 30 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Serves the cert from -tls-cert/-tls-key, picking up a new one whenever
+// either file changes, so renewing a cert doesn't need a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+
+	_, err := cr.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return cr, nil
+}
+
+// Reloads the pair if either file is newer than what we have. Reports whether
+// it did. On error the old cert stays in use.
+func (cr *certReloader) reload() (bool, error) {
+	modTime, err := cr.latestModTime()
+	if err != nil {
+		return false, err
+	}
+
+	cr.mu.RLock()
+	unchanged := cr.cert != nil && !modTime.After(cr.modTime)
+	cr.mu.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	cr.mu.Unlock()
+
+	return true, nil
+}
+
+func (cr *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+
+	for _, name := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+
+	return cr.cert, nil
+}
+
+// Polls for new cert files until done is closed.
+func (app *application) watchCertificate(cr *certReloader, done <-chan struct{}) {
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			reloaded, err := cr.reload()
+			if err != nil {
+				app.logger.PrintError(err, map[string]any{
+					"cert": cr.certFile,
+				})
+				continue
+			}
+
+			if reloaded {
+				app.logger.PrintInfo("tls certificate reloaded", map[string]any{
+					"cert": cr.certFile,
+				})
+			}
+		}
+	}
+}
+
+// Builds the server's TLS config. With -tls-client-ca set, clients may present
+// a cert signed by one of those CAs, which authenticate() then maps to a user.
+// Clients without a cert can still use tokens as normal.
+func newTLSConfig(cfg config, cr *certReloader) (*tls.Config, error) {
+	minVersion, ok := tlsVersions[cfg.tls.minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported tls version %q", cfg.tls.minVersion)
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: cr.getCertificate,
+	}
+
+	if cfg.tls.clientCA != "" {
+		pem, err := os.ReadFile(cfg.tls.clientCA)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New(cfg.tls.clientCA + ": no certificates found")
+		}
+
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsConfig, nil
+}
+
+// The identity a verified client cert claims: its first email SAN, falling
+// back to the subject CN. Service accounts are plain users with that email,
+// listed in -tls-client-accounts.
+func clientCertIdentity(cert *x509.Certificate) string {
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0]
+	}
+
+	return cert.Subject.CommonName
+}
+
+// Whether identity is in -tls-client-accounts.
+func (app *application) isServiceAccount(identity string) bool {
+	return slices.ContainsFunc(app.config.tls.clientAccounts, func(account string) bool {
+		return strings.EqualFold(account, identity)
+	})
+}
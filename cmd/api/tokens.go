@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"greenlight/internal/data"
 	"greenlight/internal/validator"
@@ -25,7 +26,7 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	v := validator.New()
 
 	data.ValidateEmail(v, input.Email)
-	data.ValidatePasswordPlaintext(v, input.Password)
+	data.ValidatePasswordLength(v, input.Password)
 
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
@@ -33,7 +34,7 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	}
 
 	// Get user record by email.
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -56,8 +57,20 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
+	// Upgrade legacy bcrypt (or outdated argon2id) hashes while we still have
+	// the plaintext. Failing here shouldn't stop the user from logging in.
+	if user.Password.NeedsRehash() {
+		err = user.Password.Set(input.Password)
+		if err == nil {
+			err = app.models.Users.Update(r.Context(), user)
+		}
+		if err != nil {
+			app.logError(r, err)
+		}
+	}
+
 	// Password correct, generate new auth token.
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 24*time.Hour, data.ScopeAuthentication)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -91,7 +104,7 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 	}
 
 	// Retrieve the corresponding user record by email.
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -111,19 +124,19 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 	}
 
 	// Create new token.
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 3*24*time.Hour, data.ScopeActivation)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 
 	// Email user with a new activation token
-	app.background(func() {
+	app.background(r.Context(), func(ctx context.Context) {
 		data := map[string]any{
 			"activationToken": token.Plaintext,
 		}
-		err := app.mailer.Send(user.Email, "token_activation.tmpl", data)
+		err := app.sendMail(ctx, user.Email, "token_activation.tmpl", data)
 		if err != nil {
-			app.logger.PrintError(err, nil)
+			app.loggerFor(ctx).PrintError(err, nil)
 		}
 	})
 
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"greenlight/internal/jsonlog"
+	"greenlight/internal/tracing"
+	"net/http"
+)
+
+// Tracer for -tracing-exporter, nil if tracing is off.
+func newTracer(cfg config, logger *jsonlog.Logger) (*tracing.Tracer, error) {
+	var exporter tracing.Exporter
+
+	switch cfg.tracing.exporter {
+	case "otlp":
+		exporter = tracing.NewOTLPExporter(cfg.tracing.endpoint)
+	case "file":
+		fe, err := tracing.NewFileExporter(cfg.tracing.file)
+		if err != nil {
+			return nil, err
+		}
+		exporter = fe
+	default:
+		return nil, nil
+	}
+
+	return tracing.New("greenlight", cfg.tracing.sampleRate, exporter, func(err error) {
+		logger.PrintError(err, map[string]any{"tracing": cfg.tracing.exporter})
+	}), nil
+}
+
+// Root span for every req, continuing the caller's trace if it sent a
+// traceparent. Named after the route once the router has matched one.
+func (app *application) trace(next http.Handler) http.Handler {
+	if app.tracer == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remote, _ := tracing.ParseTraceparent(r.Header.Get("traceparent"))
+
+		ctx, span := app.tracer.StartServer(r.Context(), r.Method, remote)
+		defer span.End()
+
+		r = r.WithContext(ctx)
+		next.ServeHTTP(w, r)
+
+		info := app.contextGetRequestInfo(r)
+		status := info.status()
+
+		if info.route != "" {
+			span.SetName(r.Method + " " + info.route)
+			span.SetAttribute("http.route", info.route)
+		}
+		span.SetAttribute("http.request.method", r.Method)
+		span.SetAttribute("url.path", r.URL.Path)
+		span.SetAttribute("http.response.status_code", status)
+		span.SetAttribute("user_agent.original", r.UserAgent())
+		span.SetAttribute("request_id", requestIDFromContext(ctx))
+		if info.userID != 0 {
+			span.SetAttribute("enduser.id", info.userID)
+		}
+
+		// 4xx is the client's problem, not a failed span.
+		if status >= 500 {
+			span.RecordError(fmt.Errorf("%d %s", status, http.StatusText(status)))
+		}
+	})
+}
+
+// Runs next in a child span called name, e.g. for a middleware or handler.
+func (app *application) traced(name string, next http.Handler) http.Handler {
+	if app.tracer == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracing.Start(r.Context(), name, tracing.KindInternal)
+		defer span.End()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Sends an email in a span of its own, see mailerFor.
+func (app *application) sendMail(ctx context.Context, recipient, templateFile string, data any) error {
+	ctx, span := tracing.Start(ctx, "mail send", tracing.KindClient)
+	defer span.End()
+
+	span.SetAttribute("mail.template", templateFile)
+
+	err := app.mailerFor(ctx).Send(recipient, templateFile, data)
+	span.RecordError(err)
+
+	return err
+}
@@ -10,11 +10,11 @@ require (
 
 require (
 	github.com/go-mail/mail/v2 v2.3.0
-	github.com/tomasen/realip v0.0.0-20180522021738-f0c99a92ddce
 	golang.org/x/time v0.3.0
 )
 
 require (
+	golang.org/x/sys v0.13.0 // indirect
 	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
 	gopkg.in/mail.v2 v2.3.1 // indirect
 )
@@ -0,0 +1,160 @@
+// Package clientip works out a request's real client IP behind reverse
+// proxies, trusting forwarding headers only when they were set by a proxy we
+// know about. Otherwise anyone could claim any IP just by sending the header.
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Headers a proxy can tell us the client IP in.
+const (
+	XForwardedFor = "X-Forwarded-For"
+	Forwarded     = "Forwarded"
+	XRealIP       = "X-Real-Ip"
+)
+
+type Resolver struct {
+	trusted []netip.Prefix
+	header  string
+}
+
+// Takes the trusted proxies as CIDRs or single IPs, and the header they put
+// the client IP in. Only that header is read, the others are whatever the
+// client sent and get passed along untouched by most proxies.
+func New(proxies []string, header string) (*Resolver, error) {
+	header = http.CanonicalHeaderKey(header)
+	if header != XForwardedFor && header != Forwarded && header != XRealIP {
+		return nil, fmt.Errorf("unsupported header %q", header)
+	}
+
+	r := &Resolver{header: header}
+
+	for _, proxy := range proxies {
+		var prefix netip.Prefix
+		var err error
+
+		if strings.Contains(proxy, "/") {
+			prefix, err = netip.ParsePrefix(proxy)
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(proxy)
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		r.trusted = append(r.trusted, prefix.Masked())
+	}
+
+	return r, nil
+}
+
+func (r *Resolver) isTrusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range r.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the client IP for req. Walks the forwarded chain from the nearest
+// hop back, for as long as each hop is a trusted proxy, and returns the first
+// address that isn't. Connections over a Unix socket come from a local proxy,
+// so they're always trusted.
+func (r *Resolver) ClientIP(req *http.Request) string {
+	peer, ok := parseAddr(req.RemoteAddr)
+	if ok && !r.isTrusted(peer) {
+		return peer.String()
+	}
+
+	hops := r.forwardedFor(req.Header)
+	if len(hops) == 0 {
+		return addrOrEmpty(peer, ok)
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, found := parseAddr(hops[i])
+		if !found {
+			// "unknown" or an obfuscated id, can't see past it. The last hop
+			// we could read is as close as we get.
+			return addrOrEmpty(peer, ok)
+		}
+
+		peer, ok = hop, true
+		if !r.isTrusted(hop) {
+			return hop.String()
+		}
+	}
+
+	// Trusted all the way, so the first hop is the client.
+	return addrOrEmpty(peer, ok)
+}
+
+func addrOrEmpty(addr netip.Addr, ok bool) string {
+	if !ok {
+		return ""
+	}
+	return addr.String()
+}
+
+// The forwarded chain from our proxy's header, client first. X-Real-Ip is a
+// chain of one.
+func (r *Resolver) forwardedFor(header http.Header) []string {
+	var hops []string
+
+	switch r.header {
+	case Forwarded:
+		for _, value := range header.Values(Forwarded) {
+			for _, element := range strings.Split(value, ",") {
+				hops = append(hops, forwardedParam(element, "for"))
+			}
+		}
+	case XRealIP:
+		if value := header.Get(XRealIP); value != "" {
+			hops = append(hops, value)
+		}
+	default:
+		for _, value := range header.Values(XForwardedFor) {
+			for _, hop := range strings.Split(value, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+	}
+
+	return hops
+}
+
+// Value of param in one Forwarded element, e.g. for="[2001:db8::1]:4711".
+func forwardedParam(element, param string) string {
+	for _, pair := range strings.Split(element, ";") {
+		key, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if found && strings.EqualFold(key, param) {
+			return strings.Trim(value, `"`)
+		}
+	}
+	return ""
+}
+
+// Parses "ip", "ip:port", "[ipv6]" or "[ipv6]:port".
+func parseAddr(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+
+	addr, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return addr.Unmap(), true
+}
@@ -0,0 +1,150 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Panics grouped by fingerprint. Everything but the counts and times is from
+// the latest one.
+type CrashReport struct {
+	ID          int64     `json:"id"`
+	Fingerprint string    `json:"fingerprint"`
+	Message     string    `json:"message"`
+	Origin      string    `json:"origin"`
+	Stack       string    `json:"stack,omitempty"`
+	Method      string    `json:"method,omitempty"`
+	Route       string    `json:"route,omitempty"`
+	UserID      int64     `json:"user_id,omitempty"`
+	RequestID   string    `json:"request_id,omitempty"`
+	Count       int64     `json:"count"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+type CrashReportModel struct {
+	DB *DB
+}
+
+// Adds a crash to the report with the same fingerprint, or starts a new one.
+func (m CrashReportModel) Record(ctx context.Context, c *CrashReport) error {
+	query := `
+		INSERT INTO crash_reports (fingerprint, message, origin, stack, method, route, user_id, request_id)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7::bigint, 0), $8)
+		ON CONFLICT (fingerprint) DO UPDATE
+		SET message = EXCLUDED.message, origin = EXCLUDED.origin, stack = EXCLUDED.stack,
+			method = EXCLUDED.method, route = EXCLUDED.route, user_id = EXCLUDED.user_id,
+			request_id = EXCLUDED.request_id, count = crash_reports.count + 1, last_seen = NOW()
+		RETURNING id, count, first_seen, last_seen
+	`
+
+	args := []any{c.Fingerprint, c.Message, c.Origin, c.Stack, c.Method, c.Route, c.UserID, c.RequestID}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&c.ID, &c.Count, &c.FirstSeen, &c.LastSeen)
+	return translateError(err)
+}
+
+func (m CrashReportModel) Get(ctx context.Context, id int64) (*CrashReport, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, fingerprint, message, origin, stack, method, route, COALESCE(user_id, 0),
+			request_id, count, first_seen, last_seen
+		FROM crash_reports
+		WHERE id = $1
+	`
+
+	var c CrashReport
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&c.ID,
+		&c.Fingerprint,
+		&c.Message,
+		&c.Origin,
+		&c.Stack,
+		&c.Method,
+		&c.Route,
+		&c.UserID,
+		&c.RequestID,
+		&c.Count,
+		&c.FirstSeen,
+		&c.LastSeen,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, translateError(err)
+		}
+	}
+
+	return &c, nil
+}
+
+// Lists reports without their stacks, Get has those.
+func (m CrashReportModel) GetAll(ctx context.Context, filters Filters) ([]*CrashReport, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, fingerprint, message, origin, method, route,
+			COALESCE(user_id, 0), request_id, count, first_seen, last_seen
+		FROM crash_reports
+		ORDER BY %s %s, id ASC
+		LIMIT $1 OFFSET $2
+		`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, translateError(err)
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	reports := []*CrashReport{}
+
+	for rows.Next() {
+		var c CrashReport
+
+		err := rows.Scan(
+			&totalRecords,
+			&c.ID,
+			&c.Fingerprint,
+			&c.Message,
+			&c.Origin,
+			&c.Method,
+			&c.Route,
+			&c.UserID,
+			&c.RequestID,
+			&c.Count,
+			&c.FirstSeen,
+			&c.LastSeen,
+		)
+		if err != nil {
+			return nil, Metadata{}, translateError(err)
+		}
+
+		reports = append(reports, &c)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, Metadata{}, translateError(err)
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return reports, metadata, nil
+}
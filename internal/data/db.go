@@ -0,0 +1,178 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"greenlight/internal/tracing"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Connection pools for the models. Writes go to the embedded primary. Reads
+// that can stand a little replication lag go through Reader(), which uses the
+// replica when there is a healthy one.
+type DB struct {
+	Pool
+
+	replica        Pool
+	replicaHealthy atomic.Bool
+}
+
+// replica may be nil, in which case everything uses primary. The replica
+// isn't used until MonitorReplica has seen it's up.
+func NewDB(primary, replica *sql.DB) *DB {
+	return &DB{
+		Pool:    Pool{DB: primary, name: "primary"},
+		replica: Pool{DB: replica, name: "replica"},
+	}
+}
+
+// A connection pool whose queries each get a tracing span. The span covers
+// running the query, not reading the rows.
+type Pool struct {
+	*sql.DB
+	name string
+}
+
+// What *sql.DB and *sql.Tx have in common.
+type conn interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// The transaction from InTx if ctx is in one, whichever pool was asked for.
+func (p Pool) conn(ctx context.Context) conn {
+	if tx, ok := ctx.Value(txContextKey).(*sql.Tx); ok {
+		return tx
+	}
+	return p.DB
+}
+
+func (p Pool) startSpan(ctx context.Context, query string) (context.Context, *tracing.Span) {
+	query = strings.Join(strings.Fields(query), " ")
+
+	// SELECT, INSERT etc. Statements only have placeholders, never values, so
+	// they're safe to record.
+	operation, _, _ := strings.Cut(query, " ")
+
+	ctx, span := tracing.Start(ctx, "sql "+operation, tracing.KindClient)
+	span.SetAttribute("db.system", "postgresql")
+	span.SetAttribute("db.statement", query)
+	span.SetAttribute("db.pool", p.name)
+
+	return ctx, span
+}
+
+func (p Pool) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	ctx, span := p.startSpan(ctx, query)
+	defer span.End()
+
+	result, err := p.conn(ctx).ExecContext(ctx, query, args...)
+	span.RecordError(err)
+
+	return result, err
+}
+
+func (p Pool) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	ctx, span := p.startSpan(ctx, query)
+	defer span.End()
+
+	rows, err := p.conn(ctx).QueryContext(ctx, query, args...)
+	span.RecordError(err)
+
+	return rows, err
+}
+
+func (p Pool) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	ctx, span := p.startSpan(ctx, query)
+	defer span.End()
+
+	// Err() is only the query's error, no rows doesn't show up until Scan.
+	row := p.conn(ctx).QueryRowContext(ctx, query, args...)
+	span.RecordError(row.Err())
+
+	return row
+}
+
+type contextKey string
+
+const primaryContextKey = contextKey("primary")
+
+const txContextKey = contextKey("tx")
+
+// Runs fn in a transaction on the primary, committed if fn returns nil and
+// rolled back otherwise. Model methods called with the ctx fn gets, reads
+// included, run in the transaction.
+func (db *DB) InTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	tx, err := db.Pool.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return translateError(err)
+	}
+
+	err = fn(context.WithValue(ctx, txContextKey, tx))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return translateError(tx.Commit())
+}
+
+// Marks ctx so reads skip the replica, e.g. for a user who just wrote
+// something and expects to see it.
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryContextKey, true)
+}
+
+func usePrimary(ctx context.Context) bool {
+	primary, _ := ctx.Value(primaryContextKey).(bool)
+	return primary
+}
+
+// Pool to run a read only query on.
+func (db *DB) Reader(ctx context.Context) Pool {
+	if usePrimary(ctx) || !db.ReplicaHealthy() {
+		return db.Pool
+	}
+	return db.replica
+}
+
+func (db *DB) Replica() *sql.DB {
+	return db.replica.DB
+}
+
+func (db *DB) ReplicaHealthy() bool {
+	return db.replica.DB != nil && db.replicaHealthy.Load()
+}
+
+// Pings the replica now and then every interval until ctx is done, sending
+// reads back to the primary while it's failing. onChange is called with the
+// first result and whenever it flips after that. Until the first ping succeeds
+// reads use the primary.
+func (db *DB) MonitorReplica(ctx context.Context, interval time.Duration, onChange func(healthy bool, err error)) {
+	if db.replica.DB == nil {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for first := true; ; first = false {
+		pingCtx, cancel := context.WithTimeout(ctx, time.Second)
+		err := db.replica.PingContext(pingCtx)
+		cancel()
+
+		healthy := err == nil
+		if db.replicaHealthy.Swap(healthy) != healthy || first {
+			onChange(healthy, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package data
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrDuplicateRecord  = errors.New("duplicate record")
+	ErrMissingReference = errors.New("referenced record does not exist")
+
+	// Wrapped around errors where trying the same thing again shortly has a
+	// decent chance of working (deadlocks, dropped connections etc).
+	ErrRetryable = errors.New("temporary database error")
+)
+
+// A CHECK, NOT NULL or foreign key constraint the db rejected. Field and
+// Message are ready to hand to a validator, if we know which field it was.
+type ConstraintError struct {
+	Constraint string
+	Field      string
+	Message    string
+	Err        error
+}
+
+func (e *ConstraintError) Error() string {
+	return fmt.Sprintf("constraint %q violated: %v", e.Constraint, e.Err)
+}
+
+func (e *ConstraintError) Unwrap() error {
+	return e.Err
+}
+
+// Errors in the same shape as validator.Errors.
+func (e *ConstraintError) Errors() map[string]string {
+	field := e.Field
+	if field == "" {
+		field = "record"
+	}
+	return map[string]string{field: e.Message}
+}
+
+// Maps our constraint names to the API field they relate to. Anything missing
+// here still gets a ConstraintError, just without a field.
+var constraintFields = map[string]struct{ field, message string }{
+	"movies_runtime_check":           {"runtime", "must be a positive integer"},
+	"movies_year_check":              {"year", "must be between 1888 and the current year"},
+	"genres_length_check":            {"genres", "must contain between 1 and 5 genres"},
+	"movies_created_by_fkey":         {"user_id", "no matching user found"},
+	"movie_submissions_status_check": {"status", "invalid status value"},
+}
+
+// Unique constraints with a dedicated error of their own.
+var uniqueErrors = map[string]error{
+	"users_email_key": ErrDuplicateEmail,
+}
+
+// Turns driver errors into something the handlers can switch on, instead of
+// them having to know pq error codes or match on err.Error(). Errors we don't
+// recognise are returned untouched.
+func translateError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		// Connection level failures never make it to a pq.Error.
+		var netErr net.Error
+		if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.ErrUnexpectedEOF) ||
+			errors.As(err, &netErr) {
+			return fmt.Errorf("%w: %w", ErrRetryable, err)
+		}
+		return err
+	}
+
+	switch pqErr.Code.Name() {
+	case "unique_violation":
+		if e, ok := uniqueErrors[pqErr.Constraint]; ok {
+			return e
+		}
+		return fmt.Errorf("%w: %w", ErrDuplicateRecord, err)
+
+	case "check_violation", "not_null_violation":
+		return newConstraintError(pqErr)
+
+	case "foreign_key_violation":
+		e := newConstraintError(pqErr)
+		e.Err = fmt.Errorf("%w: %w", ErrMissingReference, err)
+		return e
+
+	case "deadlock_detected", "serialization_failure", "admin_shutdown",
+		"crash_shutdown", "cannot_connect_now", "too_many_connections":
+		return fmt.Errorf("%w: %w", ErrRetryable, err)
+	}
+
+	// Class 08 is connection_exception and friends.
+	if pqErr.Code.Class() == "08" {
+		return fmt.Errorf("%w: %w", ErrRetryable, err)
+	}
+
+	return err
+}
+
+func newConstraintError(pqErr *pq.Error) *ConstraintError {
+	e := &ConstraintError{
+		Constraint: pqErr.Constraint,
+		Message:    "violates a database constraint",
+		Err:        pqErr,
+	}
+
+	if c, ok := constraintFields[pqErr.Constraint]; ok {
+		e.Field = c.field
+		e.Message = c.message
+	} else if pqErr.Column != "" {
+		e.Field = pqErr.Column
+		e.Message = "must be provided"
+	}
+
+	return e
+}
+
+// Reports whether err is worth retrying.
+func IsRetryable(err error) bool {
+	return errors.Is(err, ErrRetryable)
+}
@@ -0,0 +1,169 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrInvalidHashFormat = errors.New("invalid password hash format")
+
+// Tunable argon2id params.
+type Argon2Params struct {
+	Memory      uint32 // In KiB.
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// Params used when hashing new passwords. Overridden from cmd flags at startup.
+var PasswordParams = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// Each hash takes PasswordParams.Memory, so a burst of logins could take more
+// memory than we have. Only this many run at once, the rest wait. Set with
+// SetHashingBudget at startup.
+var hashingSlots = make(chan struct{}, 4)
+
+// Sizes hashingSlots so hashes running at once stay within budgetKiB, given
+// the current PasswordParams. Always lets at least one run.
+func SetHashingBudget(budgetKiB uint64) {
+	hashingSlots = make(chan struct{}, max(1, budgetKiB/uint64(PasswordParams.Memory)))
+}
+
+// argon2.IDKey, in one of hashingSlots.
+func idKey(password, salt []byte, params Argon2Params) []byte {
+	hashingSlots <- struct{}{}
+	defer func() { <-hashingSlots }()
+
+	return argon2.IDKey(password, salt, params.Iterations, params.Memory, params.Parallelism,
+		params.KeyLength)
+}
+
+// Hashes are stored in PHC string format, so the algorithm and its params
+// travel with the hash:
+//
+//	$argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+//
+// Legacy bcrypt hashes ($2a$, $2b$, ...) are still accepted when verifying.
+const argon2idPrefix = "$argon2id$"
+
+func hashPassword(plaintext string, params Argon2Params) ([]byte, error) {
+	salt := make([]byte, params.SaltLength)
+
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	key := idKey([]byte(plaintext), salt, params)
+
+	encoded := fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version,
+		params.Memory, params.Iterations, params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))
+
+	return []byte(encoded), nil
+}
+
+// Checks plaintext against a stored hash of any supported format.
+func compareHashAndPassword(hash []byte, plaintext string) (bool, error) {
+	if !strings.HasPrefix(string(hash), argon2idPrefix) {
+		err := bcrypt.CompareHashAndPassword(hash, []byte(plaintext))
+		if err != nil {
+			switch {
+			case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+				return false, nil
+			default:
+				return false, err
+			}
+		}
+		return true, nil
+	}
+
+	params, salt, key, err := decodeArgon2Hash(hash)
+	if err != nil {
+		return false, err
+	}
+
+	otherKey := idKey([]byte(plaintext), salt, params)
+
+	// Constant time compare to avoid timing attacks.
+	return subtle.ConstantTimeCompare(key, otherKey) == 1, nil
+}
+
+// Reports whether hash was made with an older algorithm or different params
+// than the ones we currently hash new passwords with.
+func hashNeedsUpgrade(hash []byte, current Argon2Params) bool {
+	params, salt, _, err := decodeArgon2Hash(hash)
+	if err != nil {
+		return true
+	}
+
+	return params.Memory != current.Memory ||
+		params.Iterations != current.Iterations ||
+		params.Parallelism != current.Parallelism ||
+		params.KeyLength != current.KeyLength ||
+		uint32(len(salt)) != current.SaltLength
+}
+
+func decodeArgon2Hash(hash []byte) (Argon2Params, []byte, []byte, error) {
+	var params Argon2Params
+
+	// Leading "$" gives us an empty first part.
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrInvalidHashFormat
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return params, nil, nil, ErrInvalidHashFormat
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations,
+		&params.Parallelism)
+	if err != nil {
+		return params, nil, nil, ErrInvalidHashFormat
+	}
+
+	// argon2 panics on p=0, and a tampered hash could ask for any amount of
+	// memory or time. Way past anything we'd configure means not one of ours.
+	if params.Parallelism == 0 || params.Iterations == 0 || params.Iterations > 100 ||
+		params.Memory < 8*uint32(params.Parallelism) || params.Memory > 4*1024*1024 {
+		return params, nil, nil, ErrInvalidHashFormat
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, ErrInvalidHashFormat
+	}
+	if len(salt) == 0 {
+		return params, nil, nil, ErrInvalidHashFormat
+	}
+	params.SaltLength = uint32(len(salt))
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, ErrInvalidHashFormat
+	}
+	if len(key) == 0 {
+		return params, nil, nil, ErrInvalidHashFormat
+	}
+	params.KeyLength = uint32(len(key))
+
+	return params, salt, key, nil
+}
@@ -1,7 +1,6 @@
 package data
 
 import (
-	"database/sql"
 	"errors"
 )
 
@@ -13,16 +12,20 @@ var (
 // Models struct to wrap models.
 type Models struct {
 	// can do Movies interface {Insert(movie *Movie) error ... etc} if need mock
+	Crashes     CrashReportModel
 	Movies      MovieModel
+	Submissions MovieSubmissionModel
 	Permissions PermissionModel
 	Tokens      TokenModel
 	Users       UserModel
 }
 
 // For ease of use
-func NewModels(db *sql.DB) Models {
+func NewModels(db *DB) Models {
 	return Models{
+		Crashes:     CrashReportModel{DB: db},
 		Movies:      MovieModel{DB: db},
+		Submissions: MovieSubmissionModel{DB: db},
 		Permissions: PermissionModel{DB: db},
 		Tokens:      TokenModel{DB: db},
 		Users:       UserModel{DB: db},
@@ -18,6 +18,7 @@ type Movie struct {
 	Year      int32     `json:"year,omitempty"`
 	Runtime   Runtime   `json:"runtime,omitempty"`
 	Genres    []string  `json:"genres,omitempty"`
+	CreatedBy int64     `json:"created_by,omitempty"` // 0 if unknown or user was deleted.
 	Version   int32     `json:"version"`
 }
 
@@ -39,46 +40,48 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 }
 
 type MovieModel struct {
-	DB *sql.DB
+	DB *DB
 }
 
 // Mutates the Movie struct passed in and adds system generated values to it.
-func (m *MovieModel) Insert(movie *Movie) error {
+func (m *MovieModel) Insert(ctx context.Context, movie *Movie) error {
 	query := `
-		INSERT INTO movies (title, year, runtime, genres)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO movies (title, year, runtime, genres, created_by)
+		VALUES ($1, $2, $3, $4, NULLIF($5::bigint, 0))
 		RETURNING id, created_at, version
 	`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	// Makes it clear what values we're using here. Need to use adapter for genres.
-	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
+	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.CreatedBy}
 
 	// Exec the query on our conn pool.
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	return translateError(err)
 }
 
-func (m *MovieModel) Get(id int64) (*Movie, error) {
+func (m *MovieModel) Get(ctx context.Context, id int64) (*Movie, error) {
 	query := `
-		SELECT id, created_at, title, year, runtime, genres, version
+		SELECT id, created_at, title, year, runtime, genres, COALESCE(created_by, 0), version
 		FROM movies
 		WHERE id = $1
 	`
 	var movie Movie
 
 	// Create a ctx which carries a 3 second deadline.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+	err := m.DB.Reader(ctx).QueryRowContext(ctx, query, id).Scan(
 		&movie.ID,
 		&movie.CreatedAt,
 		&movie.Title,
 		&movie.Year,
 		&movie.Runtime,
 		pq.Array(&movie.Genres),
+		&movie.CreatedBy,
 		&movie.Version,
 	)
 
@@ -87,18 +90,19 @@ func (m *MovieModel) Get(id int64) (*Movie, error) {
 		case errors.Is(err, sql.ErrNoRows):
 			return nil, ErrRecordNotFound
 		default:
-			return nil, err
+			return nil, translateError(err)
 		}
 	}
 
 	return &movie, nil
 }
 
-func (m *MovieModel) Update(movie *Movie) error {
+func (m *MovieModel) Update(ctx context.Context, movie *Movie) error {
 	query := `
 		UPDATE movies
-		SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
-		WHERE id = $5 AND version = $6
+		SET title = $1, year = $2, runtime = $3, genres = $4, created_by = NULLIF($5::bigint, 0),
+			version = version + 1
+		WHERE id = $6 AND version = $7
 		RETURNING version
 	`
 
@@ -107,11 +111,12 @@ func (m *MovieModel) Update(movie *Movie) error {
 		movie.Year,
 		movie.Runtime,
 		pq.Array(movie.Genres),
+		movie.CreatedBy,
 		movie.ID,
 		movie.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	// If no matching row found, we know the movie version has changed (or record
@@ -122,14 +127,14 @@ func (m *MovieModel) Update(movie *Movie) error {
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
 		default:
-			return err
+			return translateError(err)
 		}
 	}
 
 	return nil
 }
 
-func (m *MovieModel) Delete(id int64) error {
+func (m *MovieModel) Delete(ctx context.Context, id int64) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
@@ -139,18 +144,18 @@ func (m *MovieModel) Delete(id int64) error {
 		WHERE id = $1
 	`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	result, err := m.DB.ExecContext(ctx, query, id)
 	if err != nil {
-		return err
+		return translateError(err)
 	}
 
 	// Check num of rows affected by query
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		return err
+		return translateError(err)
 	}
 
 	// If no rows affected, we know the table didn't contain a record with given ID
@@ -161,14 +166,15 @@ func (m *MovieModel) Delete(id int64) error {
 	return nil
 }
 
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+func (m MovieModel) GetAll(ctx context.Context, title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
 	// to_tsvector takes a title and splits it into `lexemes`. Simple means it's
 	// just a lowercase version of word in title.
 	// plainto_tsquery takes a search value and turns it into formatted query term
 	// that postgres full text search can understand. Normalizes and strips.
 	// @@ is `matches` operator. Check if query term matches lexemes.
 	query := fmt.Sprintf(`
-		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
+		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres,
+			COALESCE(created_by, 0), version
 		FROM movies
 		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
 		AND (genres @> $2 or $2 = '{}')
@@ -176,14 +182,14 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 		LIMIT $3 OFFSET $4
 		`, filters.sortColumn(), filters.sortDirection())
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	args := []any{title, pq.Array(genres), filters.limit(), filters.offset()}
 
-	rows, err := m.DB.QueryContext(ctx, query, args...)
+	rows, err := m.DB.Reader(ctx).QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, Metadata{}, err
+		return nil, Metadata{}, translateError(err)
 	}
 
 	// Ensure that resultset is closed.
@@ -207,11 +213,12 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&movie.Year,
 			&movie.Runtime,
 			pq.Array(&movie.Genres),
+			&movie.CreatedBy,
 			&movie.Version,
 		)
 
 		if err != nil {
-			return nil, Metadata{}, err
+			return nil, Metadata{}, translateError(err)
 		}
 
 		// Add Movie struct to the slice.
@@ -220,7 +227,7 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 
 	// Check for any errors during iteration.
 	if err := rows.Err(); err != nil {
-		return nil, Metadata{}, err
+		return nil, Metadata{}, translateError(err)
 	}
 
 	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
@@ -0,0 +1,267 @@
+package data
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Rules applied to new passwords on top of the length checks. Set from cmd
+// flags at startup.
+type PasswordPolicy struct {
+	// Local breached password corpus. Nil means no breach check.
+	Breached *BreachedPasswords
+	// Minimum score (0-4) from EstimatePasswordStrength.
+	MinScore int
+}
+
+var Policy = PasswordPolicy{
+	MinScore: 2,
+}
+
+// Most hashes LoadBreachedPasswords takes, 8 bytes each so ~160MB. The full
+// HIBP set is close to a billion, several GB, so use a cut of the most common
+// ones (the downloads can be sorted by count).
+const MaxBreachedPasswords = 20_000_000
+
+// In memory set of breached password SHA-1 hashes. Only the first 8 bytes of
+// each hash are kept, which is plenty to avoid false positives.
+type BreachedPasswords struct {
+	prefixes []uint64
+}
+
+// Loads a breached password file. Each line holds a hex SHA-1 hash (or at least
+// its first 16 hex chars), optionally followed by ":count" as in the HIBP
+// downloads. Blank lines and lines starting with # are ignored. Lines should
+// be sorted by hash; if they're not, we sort them once here.
+func LoadBreachedPasswords(path string) (*BreachedPasswords, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := &BreachedPasswords{}
+	sorted := true
+
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		hash, _, _ := strings.Cut(line, ":")
+		if len(hash) < 16 {
+			return nil, fmt.Errorf("%s:%d: hash prefix must be at least 16 hex chars", path, lineNo)
+		}
+
+		raw, err := hex.DecodeString(hash[:16])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+
+		if len(b.prefixes) == MaxBreachedPasswords {
+			return nil, fmt.Errorf("%s: more than %d hashes, use a smaller corpus", path, MaxBreachedPasswords)
+		}
+
+		prefix := binary.BigEndian.Uint64(raw)
+		if n := len(b.prefixes); n > 0 && b.prefixes[n-1] > prefix {
+			sorted = false
+		}
+
+		b.prefixes = append(b.prefixes, prefix)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if !sorted {
+		slices.Sort(b.prefixes)
+	}
+
+	return b, nil
+}
+
+// Number of hashes in the corpus.
+func (b *BreachedPasswords) Len() int {
+	return len(b.prefixes)
+}
+
+// Checks whether the plaintext password appears in the corpus.
+func (b *BreachedPasswords) Contains(plaintext string) bool {
+	sum := sha1.Sum([]byte(plaintext))
+	_, found := slices.BinarySearch(b.prefixes, binary.BigEndian.Uint64(sum[:8]))
+	return found
+}
+
+// Small list of base words that show up in nearly every breach. Stripped out
+// before estimating entropy, so "Password123!" doesn't score as strong.
+var commonPasswordWords = []string{
+	"password", "passw0rd", "qwerty", "letmein", "welcome", "admin", "login",
+	"iloveyou", "monkey", "dragon", "football", "baseball", "master", "shadow",
+	"sunshine", "princess", "trustno1", "superman", "batman", "secret",
+	"greenlight", "movie", "abc123", "changeme",
+}
+
+var sequences = []string{
+	"abcdefghijklmnopqrstuvwxyz",
+	"01234567890",
+	"qwertyuiop",
+	"asdfghjkl",
+	"zxcvbnm",
+}
+
+// Rough zxcvbn-style strength estimate returning a score from 0 (terrible) to
+// 4 (strong). Common words, repeated chars, sequences and anything the user
+// supplied elsewhere (email, name) don't count towards the effective length.
+func EstimatePasswordStrength(password string, userInputs ...string) int {
+	lower := strings.ToLower(password)
+
+	// Blank out the predictable parts. Each removed chunk still counts as a
+	// single "char", since the attacker has to guess which word it was.
+	guessable := append(slices.Clone(commonPasswordWords), userInputTokens(userInputs...)...)
+	removed := 0
+	for _, word := range guessable {
+		for strings.Contains(lower, word) {
+			lower = strings.Replace(lower, word, "\x00", 1)
+			removed++
+		}
+	}
+
+	runes := []rune(lower)
+	effective := float64(removed)
+
+	for i, r := range runes {
+		if r == 0 {
+			continue
+		}
+
+		if i > 0 && (r == runes[i-1] || isSequential(runes[i-1], r)) {
+			// Repeats and sequences add very little.
+			effective += 0.25
+			continue
+		}
+
+		effective++
+	}
+
+	bits := effective * math.Log2(float64(charsetSize(password)))
+
+	switch {
+	case bits < 28:
+		return 0
+	case bits < 36:
+		return 1
+	case bits < 60:
+		return 2
+	case bits < 80:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// Splits emails and names into lowercase tokens worth checking for, e.g.
+// "Alice Smith", "alice.smith@example.com" -> alice smith alice.smith ...
+func userInputTokens(inputs ...string) []string {
+	var tokens []string
+
+	for _, input := range inputs {
+		input = strings.ToLower(strings.TrimSpace(input))
+		if input == "" {
+			continue
+		}
+
+		tokens = append(tokens, input)
+
+		local, _, _ := strings.Cut(input, "@")
+		tokens = append(tokens, local)
+		tokens = append(tokens, strings.FieldsFunc(local, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})...)
+	}
+
+	// Tokens under 3 chars would match far too much.
+	tokens = slices.DeleteFunc(tokens, func(t string) bool { return len(t) < 3 })
+
+	// Longest first so we strip the full email before its parts.
+	slices.SortFunc(tokens, func(a, b string) int { return len(b) - len(a) })
+
+	return slices.Compact(tokens)
+}
+
+func isSequential(prev, cur rune) bool {
+	for _, seq := range sequences {
+		i := strings.IndexRune(seq, prev)
+		j := strings.IndexRune(seq, cur)
+		if i >= 0 && j >= 0 && (j-i == 1 || i-j == 1) {
+			return true
+		}
+	}
+	return false
+}
+
+func charsetSize(password string) int {
+	var lower, upper, digit, symbol, other bool
+
+	for _, r := range password {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	size := 0
+	if lower {
+		size += 26
+	}
+	if upper {
+		size += 26
+	}
+	if digit {
+		size += 10
+	}
+	if symbol {
+		size += 33
+	}
+	if other {
+		size += 100
+	}
+
+	// Avoid log2(0) and log2(1) for empty or single class inputs.
+	return max(size, 2)
+}
+
+// True if the password contains the user's email, its local part or any
+// word of their name.
+func containsUserInput(password string, userInputs ...string) bool {
+	lower := strings.ToLower(password)
+
+	for _, token := range userInputTokens(userInputs...) {
+		if strings.Contains(lower, token) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -2,7 +2,6 @@ package data
 
 import (
 	"context"
-	"database/sql"
 	"time"
 
 	"github.com/lib/pq"
@@ -22,11 +21,13 @@ func (p Permissions) Include(code string) bool {
 }
 
 type PermissionModel struct {
-	DB *sql.DB
+	DB *DB
 }
 
-// Returns all permission codes for a user in a Permissions slice.
-func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+// Returns all permission codes for a user in a Permissions slice. Always from
+// the primary, a revoked permission mustn't keep working while the replica
+// catches up.
+func (m PermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
 	query := `
 		SELECT permissions.code
 		FROM permissions
@@ -35,12 +36,12 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 		WHERE users.id = $1
 	`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	rows, err := m.DB.QueryContext(ctx, query, userID)
 	if err != nil {
-		return nil, err
+		return nil, translateError(err)
 	}
 	defer rows.Close()
 
@@ -50,28 +51,28 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 
 		err := rows.Scan(&permission)
 		if err != nil {
-			return nil, err
+			return nil, translateError(err)
 		}
 
 		permissions = append(permissions, permission)
 	}
 
 	if err = rows.Err(); err != nil {
-		return nil, err
+		return nil, translateError(err)
 	}
 
 	return permissions, nil
 }
 
 // Adds one or more permission codes for a specific user.
-func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
+func (m PermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
 	query := `
 		INSERT INTO users_permissions
 		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
 	`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
-	return err
+	return translateError(err)
 }
@@ -0,0 +1,202 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	SubmissionPending  = "pending"
+	SubmissionApproved = "approved"
+	SubmissionRejected = "rejected"
+)
+
+// A proposed new movie (MovieID 0) or edit to an existing one, waiting for
+// someone with movies:approve to review it.
+type MovieSubmission struct {
+	ID           int64      `json:"id"`
+	CreatedAt    time.Time  `json:"created_at"`
+	SubmitterID  int64      `json:"submitter_id"`
+	MovieID      int64      `json:"movie_id,omitempty"`
+	MovieVersion int32      `json:"movie_version,omitempty"` // Of the movie when an edit was submitted.
+	Title        string     `json:"title"`
+	Year         int32      `json:"year"`
+	Runtime      Runtime    `json:"runtime"`
+	Genres       []string   `json:"genres"`
+	Status       string     `json:"status"`
+	ReviewerID   int64      `json:"reviewer_id,omitempty"`
+	Comment      string     `json:"comment,omitempty"`
+	ReviewedAt   *time.Time `json:"reviewed_at,omitempty"`
+	Version      int32      `json:"version"`
+}
+
+// Returns the proposed movie values, e.g. for running ValidateMovie.
+func (s *MovieSubmission) Movie() *Movie {
+	return &Movie{
+		ID:        s.MovieID,
+		Title:     s.Title,
+		Year:      s.Year,
+		Runtime:   s.Runtime,
+		Genres:    s.Genres,
+		CreatedBy: s.SubmitterID,
+	}
+}
+
+type MovieSubmissionModel struct {
+	DB *DB
+}
+
+func (m MovieSubmissionModel) Insert(ctx context.Context, s *MovieSubmission) error {
+	query := `
+		INSERT INTO movie_submissions (submitter_id, movie_id, movie_version, title, year, runtime, genres)
+		VALUES ($1, NULLIF($2::bigint, 0), $3, $4, $5, $6, $7)
+		RETURNING id, created_at, status, version
+	`
+
+	args := []any{s.SubmitterID, s.MovieID, s.MovieVersion, s.Title, s.Year, s.Runtime, pq.Array(s.Genres)}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&s.ID, &s.CreatedAt, &s.Status, &s.Version)
+	return translateError(err)
+}
+
+func (m MovieSubmissionModel) Get(ctx context.Context, id int64) (*MovieSubmission, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, submitter_id, COALESCE(movie_id, 0), movie_version, title, year,
+			runtime, genres, status, COALESCE(reviewer_id, 0), comment, reviewed_at, version
+		FROM movie_submissions
+		WHERE id = $1
+	`
+
+	var s MovieSubmission
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.Reader(ctx).QueryRowContext(ctx, query, id).Scan(
+		&s.ID,
+		&s.CreatedAt,
+		&s.SubmitterID,
+		&s.MovieID,
+		&s.MovieVersion,
+		&s.Title,
+		&s.Year,
+		&s.Runtime,
+		pq.Array(&s.Genres),
+		&s.Status,
+		&s.ReviewerID,
+		&s.Comment,
+		&s.ReviewedAt,
+		&s.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, translateError(err)
+		}
+	}
+
+	return &s, nil
+}
+
+// Returns submissions with the given status, or all of them if status is "".
+func (m MovieSubmissionModel) GetAll(ctx context.Context, status string, filters Filters) ([]*MovieSubmission, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, submitter_id, COALESCE(movie_id, 0), movie_version,
+			title, year, runtime, genres, status, COALESCE(reviewer_id, 0), comment, reviewed_at, version
+		FROM movie_submissions
+		WHERE (status = $1 OR $1 = '')
+		ORDER BY %s %s, id ASC
+		LIMIT $2 OFFSET $3
+		`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Reader(ctx).QueryContext(ctx, query, status, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, translateError(err)
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	submissions := []*MovieSubmission{}
+
+	for rows.Next() {
+		var s MovieSubmission
+
+		err := rows.Scan(
+			&totalRecords,
+			&s.ID,
+			&s.CreatedAt,
+			&s.SubmitterID,
+			&s.MovieID,
+			&s.MovieVersion,
+			&s.Title,
+			&s.Year,
+			&s.Runtime,
+			pq.Array(&s.Genres),
+			&s.Status,
+			&s.ReviewerID,
+			&s.Comment,
+			&s.ReviewedAt,
+			&s.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, translateError(err)
+		}
+
+		submissions = append(submissions, &s)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, Metadata{}, translateError(err)
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return submissions, metadata, nil
+}
+
+// Saves the review outcome. Optimistic locking on version stops two reviewers
+// from deciding on the same submission at once.
+func (m MovieSubmissionModel) Update(ctx context.Context, s *MovieSubmission) error {
+	query := `
+		UPDATE movie_submissions
+		SET movie_id = NULLIF($1::bigint, 0), status = $2, reviewer_id = NULLIF($3::bigint, 0),
+			comment = $4, reviewed_at = $5, version = version + 1
+		WHERE id = $6 AND version = $7
+		RETURNING version
+	`
+
+	args := []any{s.MovieID, s.Status, s.ReviewerID, s.Comment, s.ReviewedAt, s.ID, s.Version}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&s.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return translateError(err)
+		}
+	}
+
+	return nil
+}
@@ -7,8 +7,6 @@ import (
 	"errors"
 	"greenlight/internal/validator"
 	"time"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 var (
@@ -16,7 +14,7 @@ var (
 )
 
 type UserModel struct {
-	DB *sql.DB
+	DB *DB
 }
 
 var AnonymousUser = &User{}
@@ -43,10 +41,10 @@ type password struct {
 	hash      []byte
 }
 
-// Calculates the bcrypt hash of a plaintext pswd and stores both hash and plaintext
-// versions in the struct.
+// Calculates the argon2id hash of a plaintext pswd and stores both hash and
+// plaintext versions in the struct.
 func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+	hash, err := hashPassword(plaintextPassword, PasswordParams)
 	if err != nil {
 		return err
 	}
@@ -58,18 +56,15 @@ func (p *password) Set(plaintextPassword string) error {
 }
 
 // Checks if provided plaintext password matches the hashed password strored in struct.
+// Works for both current argon2id hashes and legacy bcrypt ones.
 func (p *password) Matches(plaintextPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
-	}
+	return compareHashAndPassword(p.hash, plaintextPassword)
+}
 
-	return true, nil
+// True if the stored hash uses an old algorithm or outdated params. Only makes
+// sense to act on this right after a successful Matches(), when we have the plaintext.
+func (p *password) NeedsRehash() bool {
+	return hashNeedsUpgrade(p.hash, PasswordParams)
 }
 
 func ValidateEmail(v *validator.Validator, email string) {
@@ -77,10 +72,36 @@ func ValidateEmail(v *validator.Validator, email string) {
 	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be a valid email address")
 }
 
-func ValidatePasswordPlaintext(v *validator.Validator, password string) {
+// Only the basic shape checks. Used when logging in, where we shouldn't lock
+// people out because their password later turned up in a breach.
+func ValidatePasswordLength(v *validator.Validator, password string) {
 	v.Check(password != "", "password", "must be provided")
 	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+	// No longer bound by bcrypt's 72 byte limit, but still cap it so nobody can
+	// make us hash megabytes of input.
+	v.Check(len(password) <= 1024, "password", "must not be more than 1024 bytes long")
+}
+
+// Full checks for a new password. userInputs are things like the user's email
+// and name, which the password must not contain.
+func ValidatePasswordPlaintext(v *validator.Validator, password string, userInputs ...string) {
+	ValidatePasswordLength(v, password)
+
+	// Don't bother with the rest if the basics failed.
+	if _, exists := v.Errors["password"]; exists {
+		return
+	}
+
+	if Policy.Breached != nil {
+		v.Check(!Policy.Breached.Contains(password), "password",
+			"has appeared in a data breach, please choose a different password")
+	}
+
+	v.Check(!containsUserInput(password, userInputs...), "password",
+		"must not contain your email address or name")
+
+	v.Check(EstimatePasswordStrength(password, userInputs...) >= Policy.MinScore, "password",
+		"is too easy to guess, try a longer password or a less common phrase")
 }
 
 func ValidateUser(v *validator.Validator, user *User) {
@@ -90,7 +111,7 @@ func ValidateUser(v *validator.Validator, user *User) {
 	ValidateEmail(v, user.Email)
 
 	if user.Password.plaintext != nil {
-		ValidatePasswordPlaintext(v, *user.Password.plaintext)
+		ValidatePasswordPlaintext(v, *user.Password.plaintext, user.Email, user.Name)
 	}
 
 	// logic error somewhere (forgot to set pass for a user). Sanity check.
@@ -99,7 +120,7 @@ func ValidateUser(v *validator.Validator, user *User) {
 	}
 }
 
-func (m UserModel) Insert(user *User) error {
+func (m UserModel) Insert(ctx context.Context, user *User) error {
 	query := `
 		INSERT INTO users (name, email, password_hash, activated)
 		VALUES ($1, $2, $3, $4)
@@ -108,25 +129,55 @@ func (m UserModel) Insert(user *User) error {
 
 	args := []any{user.Name, user.Email, user.Password.hash, user.Activated}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
 		&user.ID, &user.CreatedAt, &user.Version)
+	return translateError(err)
+}
+
+// Retrieve User details from DB based on ID.
+func (m UserModel) Get(ctx context.Context, id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, name, email, password_hash, activated, version
+		FROM users
+		WHERE id = $1
+	`
+	var user User
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.Reader(ctx).QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+
 	if err != nil {
 		switch {
-		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
-			return ErrDuplicateEmail
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
 		default:
-			return err
+			return nil, translateError(err)
 		}
 	}
 
-	return nil
+	return &user, nil
 }
 
-// Retrieve User details from DB based on email address. Unique.
-func (m UserModel) GetByEmail(email string) (*User, error) {
+// Retrieve User details from DB based on email address. Unique. From the
+// primary, since logins check the password hash and activated flag on it.
+func (m UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
 	query := `
 		SELECT id, created_at, name, email, password_hash, activated, version
 		FROM users
@@ -134,7 +185,7 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 	`
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, email).Scan(
@@ -152,14 +203,14 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		case errors.Is(err, sql.ErrNoRows):
 			return nil, ErrRecordNotFound
 		default:
-			return nil, err
+			return nil, translateError(err)
 		}
 	}
 
 	return &user, nil
 }
 
-func (m UserModel) Update(user *User) error {
+func (m UserModel) Update(ctx context.Context, user *User) error {
 	query := `
 		UPDATE users
 		SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
@@ -176,25 +227,23 @@ func (m UserModel) Update(user *User) error {
 		user.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
 	if err != nil {
 		switch {
-		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
-			return ErrDuplicateEmail
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
 		default:
-			return err
+			return translateError(err)
 		}
 	}
 
 	return nil
 }
 
-func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
 	query := `
 		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, 
 			users.activated, users.version
@@ -213,7 +262,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
@@ -230,7 +279,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		case errors.Is(err, sql.ErrNoRows):
 			return nil, ErrRecordNotFound
 		default:
-			return nil, err
+			return nil, translateError(err)
 		}
 	}
 
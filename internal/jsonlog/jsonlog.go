@@ -2,28 +2,39 @@ package jsonlog
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
+	"maps"
 	"os"
 	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// Represents severity level of a log entry.
+// Represents severity level of a log entry. Same values as log/slog's, so the
+// two convert cleanly, see Handler().
 type Level int8
 
 const (
-	LevelInfo  Level = iota // Has value 0.
-	LevelError              // Value 1.
-	LevelFatal              // Value 2.
-	LevelOff                // Value 3.
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+	LevelFatal Level = 12
+	LevelOff   Level = 16
 )
 
 // Return human friendly string for the severity level.
 func (l Level) String() string {
 	switch l {
+	case LevelDebug:
+		return "DEBUG"
 	case LevelInfo:
 		return "INFO"
+	case LevelWarn:
+		return "WARN"
 	case LevelError:
 		return "ERROR"
 	case LevelFatal:
@@ -33,61 +44,161 @@ func (l Level) String() string {
 	}
 }
 
-// Holds output dst, minimum written severity level, mutex for coordinating writes
+// Parses a level name as used in config, e.g. "info". Case insensitive.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	case "fatal":
+		return LevelFatal, nil
+	case "off":
+		return LevelOff, nil
+	default:
+		return 0, fmt.Errorf("unknown log level %q", s)
+	}
+}
+
+// Holds output dst, minimum written severity level, the level from which
+// entries get a stack trace, property keys to redact, mutex for coordinating
+// writes and properties added to every entry. Loggers made by With() share all
+// but the last with their parent.
 type Logger struct {
-	out      io.Writer
-	minLevel Level
-	mu       sync.Mutex
+	out        io.Writer
+	minLevel   *atomic.Int32 // Level, atomic so it can change at runtime.
+	stackLevel *atomic.Int32 // Same.
+	redactKeys *atomic.Pointer[map[string]bool]
+	mu         *sync.Mutex
+	properties map[string]any
 }
 
+// Entries at this level and up get a stack trace unless SetStackLevel says
+// otherwise. Errors are mostly expected ones (a DB timeout, SMTP down) where a
+// trace is just noise, and panics carry their own.
+const DefaultStackLevel = LevelFatal
+
+// Stack traces start at DefaultStackLevel and no keys are redacted, see
+// SetStackLevel and SetRedactKeys. Emails and secrets in URLs always are.
 func New(out io.Writer, minLevel Level) *Logger {
-	return &Logger{
-		out:      out,
-		minLevel: minLevel,
+	l := &Logger{
+		out:        out,
+		minLevel:   new(atomic.Int32),
+		stackLevel: new(atomic.Int32),
+		redactKeys: new(atomic.Pointer[map[string]bool]),
+		mu:         new(sync.Mutex),
+	}
+	l.SetLevel(minLevel)
+	l.SetStackLevel(DefaultStackLevel)
+	l.SetRedactKeys()
+	return l
+}
+
+// Returns a logger which adds properties to every entry, e.g. a request ID.
+// Properties passed to the Print methods win over these.
+func (l *Logger) With(properties map[string]any) *Logger {
+	merged := make(map[string]any, len(l.properties)+len(properties))
+	maps.Copy(merged, l.properties)
+	maps.Copy(merged, properties)
+
+	child := *l
+	child.properties = merged
+	return &child
+}
+
+// Changes the minimum severity level. Safe to call while logging.
+func (l *Logger) SetLevel(minLevel Level) {
+	l.minLevel.Store(int32(minLevel))
+}
+
+// Entries at stackLevel and above get a stack trace. LevelOff means never.
+// Safe to call while logging.
+func (l *Logger) SetStackLevel(stackLevel Level) {
+	l.stackLevel.Store(int32(stackLevel))
+}
+
+// Properties with these keys, at any depth, are written as "[redacted]".
+// Case insensitive. Safe to call while logging.
+func (l *Logger) SetRedactKeys(keys ...string) {
+	set := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		set[strings.ToLower(key)] = true
 	}
+	l.redactKeys.Store(&set)
+}
+
+// Reports whether entries at level would be written.
+func (l *Logger) Enabled(level Level) bool {
+	return int32(level) >= l.minLevel.Load()
 }
 
 // Helpers methods for writing log entries at different levels.
 // All accept a map as second param which can be any arbitrary properties we
-// want to appear in the log entry.
+// want to appear in the log entry. Values can be anything JSON can take,
+// nested maps and structs included. Durations come out as e.g. "1.5s" and
+// errors as their message.
+
+func (l *Logger) PrintDebug(message string, properties map[string]any) {
+	l.print(LevelDebug, message, properties)
+}
 
-func (l *Logger) PrintInfo(message string, properties map[string]string) {
+func (l *Logger) PrintInfo(message string, properties map[string]any) {
 	l.print(LevelInfo, message, properties)
 }
 
-func (l *Logger) PrintError(err error, properties map[string]string) {
-	l.print(LevelError, err.Error(), properties)
+func (l *Logger) PrintWarn(message string, properties map[string]any) {
+	l.print(LevelWarn, message, properties)
 }
 
-func (l *Logger) PrintFatal(err error, properties map[string]string) {
+func (l *Logger) PrintError(err error, properties map[string]any) {
 	l.print(LevelError, err.Error(), properties)
+}
+
+func (l *Logger) PrintFatal(err error, properties map[string]any) {
+	l.print(LevelFatal, err.Error(), properties)
 	os.Exit(1) // Terminate the app if FATAL error.
 }
 
 // Internal method for writing the log entry.
-func (l *Logger) print(level Level, message string, properties map[string]string) (int, error) {
+func (l *Logger) print(level Level, message string, properties map[string]any) (int, error) {
 	// If the severity level of the log entry is below the minimum severity for the
 	// logger, then return with no further action.
-	if level < l.minLevel {
+	if !l.Enabled(level) {
 		return 0, nil
 	}
 
+	// Merge in our own properties, turn values json doesn't do well into
+	// something readable and mask anything sensitive. Never touches the
+	// caller's map.
+	merged := make(map[string]any, len(l.properties)+len(properties))
+	maps.Copy(merged, l.properties)
+	maps.Copy(merged, properties)
+
+	redactKeys := *l.redactKeys.Load()
+	for key, value := range merged {
+		merged[key] = redact(key, normalize(value), redactKeys)
+	}
+
 	// Declare an anonymous struct holding the data for the log entry.
 	aux := struct {
-		Level      string            `json:"level"`
-		Time       string            `json:"time"`
-		Message    string            `json:"message"`
-		Properties map[string]string `json:"properties,omitempty"`
-		Trace      string            `json:"trace,omitempty"`
+		Level      string         `json:"level"`
+		Time       string         `json:"time"`
+		Message    string         `json:"message"`
+		Properties map[string]any `json:"properties,omitempty"`
+		Trace      string         `json:"trace,omitempty"`
 	}{
 		Level:      level.String(),
 		Time:       time.Now().UTC().Format(time.RFC3339),
-		Message:    message,
-		Properties: properties,
+		Message:    Redact(message),
+		Properties: merged,
 	}
 
-	// Include a stack trace for entries at the ERROR and FATAL levels.
-	if level >= LevelError {
+	// Include a stack trace for entries at the stack level and up.
+	if int32(level) >= l.stackLevel.Load() {
 		aux.Trace = string(debug.Stack())
 	}
 
@@ -118,3 +229,21 @@ func (l *Logger) print(level Level, message string, properties map[string]string
 func (l *Logger) Write(message []byte) (n int, err error) {
 	return l.print(LevelError, string(message), nil)
 }
+
+// json.Marshal would write a Duration as nanoseconds and an error as {}.
+func normalize(value any) any {
+	switch v := value.(type) {
+	case time.Duration:
+		return v.String()
+	case error:
+		return v.Error()
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for key, value := range v {
+			out[key] = normalize(value)
+		}
+		return out
+	default:
+		return value
+	}
+}
@@ -0,0 +1,62 @@
+package jsonlog
+
+import (
+	"regexp"
+	"strings"
+)
+
+const redacted = "[redacted]"
+
+var (
+	emailRX = regexp.MustCompile(`([A-Za-z0-9._%+-])[A-Za-z0-9._%+-]*@([A-Za-z0-9.-]+\.[A-Za-z]{2,})`)
+
+	// token=..., authorization=... etc in query strings and form bodies.
+	secretParamRX = regexp.MustCompile(`(?i)\b([a-z_]*(?:token|authorization|password|secret))=[^&\s"']*`)
+
+	// Authorization header values.
+	credentialsRX = regexp.MustCompile(`(?i)\b(bearer|basic)\s+[A-Za-z0-9._~+/=-]+`)
+)
+
+// Masks emails (keeping the first letter and the domain, enough to tell
+// users apart when debugging) and secrets in URLs and headers. Log messages get
+// this, and so should text stored somewhere other than the log, e.g. crash
+// reports.
+func Redact(s string) string {
+	s = emailRX.ReplaceAllString(s, "$1***@$2")
+	s = secretParamRX.ReplaceAllString(s, "$1="+redacted)
+	s = credentialsRX.ReplaceAllString(s, "$1 "+redacted)
+	return s
+}
+
+// Redacts value if key is one of keys, else the strings in it. Only looks
+// into the types normalize() leaves behind, anything else goes out as is.
+func redact(key string, value any, keys map[string]bool) any {
+	if keys[strings.ToLower(key)] {
+		return redacted
+	}
+
+	switch v := value.(type) {
+	case string:
+		return Redact(v)
+	case []string:
+		out := make([]string, len(v))
+		for i, s := range v {
+			out[i] = Redact(s)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, value := range v {
+			out[k] = redact(k, value, keys)
+		}
+		return out
+	case map[string]string:
+		out := make(map[string]any, len(v))
+		for k, value := range v {
+			out[k] = redact(k, value, keys)
+		}
+		return out
+	default:
+		return value
+	}
+}
@@ -0,0 +1,132 @@
+package jsonlog
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+)
+
+// Returns a log/slog handler that writes through l, for libraries that log
+// with slog. Attributes become properties, groups become nested objects.
+func (l *Logger) Handler() slog.Handler {
+	return &slogHandler{logger: l}
+}
+
+type slogHandler struct {
+	logger     *Logger
+	properties map[string]any // From WithAttrs, already nested under their groups.
+	groups     []string       // From WithGroup, where new attrs go.
+}
+
+func fromSlogLevel(level slog.Level) Level {
+	switch {
+	case level < slog.LevelInfo:
+		return LevelDebug
+	case level < slog.LevelWarn:
+		return LevelInfo
+	case level < slog.LevelError:
+		return LevelWarn
+	default:
+		return LevelError
+	}
+}
+
+func (h *slogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return h.logger.Enabled(fromSlogLevel(level))
+}
+
+func (h *slogHandler) Handle(_ context.Context, r slog.Record) error {
+	attrs := make(map[string]any, r.NumAttrs())
+	r.Attrs(func(a slog.Attr) bool {
+		addAttr(attrs, a)
+		return true
+	})
+
+	properties := h.withProperties(attrs)
+
+	_, err := h.logger.print(fromSlogLevel(r.Level), r.Message, properties)
+	return err
+}
+
+func (h *slogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	added := make(map[string]any, len(attrs))
+	for _, a := range attrs {
+		addAttr(added, a)
+	}
+
+	return &slogHandler{logger: h.logger, properties: h.withProperties(added), groups: h.groups}
+}
+
+// Copy of our properties with added put under the current group. Groups
+// that would end up empty are left out, as slog's own handlers do.
+func (h *slogHandler) withProperties(added map[string]any) map[string]any {
+	properties := cloneProperties(h.properties)
+	if len(added) > 0 {
+		maps.Copy(groupMap(properties, h.groups), added)
+	}
+	return properties
+}
+
+func (h *slogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+
+	// Capped so appending never writes into a sibling handler's groups.
+	groups := append(h.groups[:len(h.groups):len(h.groups)], name)
+	return &slogHandler{logger: h.logger, properties: h.properties, groups: groups}
+}
+
+// The map for the innermost of groups, creating any that don't exist yet.
+func groupMap(properties map[string]any, groups []string) map[string]any {
+	for _, group := range groups {
+		next, ok := properties[group].(map[string]any)
+		if !ok {
+			next = make(map[string]any)
+			properties[group] = next
+		}
+		properties = next
+	}
+	return properties
+}
+
+func addAttr(properties map[string]any, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+
+	if a.Value.Kind() == slog.KindGroup {
+		attrs := a.Value.Group()
+		if len(attrs) == 0 {
+			return
+		}
+
+		// A group with no key is inlined, as slog's own handlers do.
+		target := properties
+		if a.Key != "" {
+			target = groupMap(properties, []string{a.Key})
+		}
+		for _, attr := range attrs {
+			addAttr(target, attr)
+		}
+		return
+	}
+
+	if a.Key == "" {
+		return
+	}
+
+	properties[a.Key] = a.Value.Any()
+}
+
+// Deep copy, so handlers derived from each other never share nested groups.
+func cloneProperties(properties map[string]any) map[string]any {
+	out := make(map[string]any, len(properties))
+	maps.Copy(out, properties)
+
+	for key, value := range out {
+		if nested, ok := value.(map[string]any); ok {
+			out[key] = cloneProperties(nested)
+		}
+	}
+
+	return out
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"embed"
 	"html/template"
+	"maps"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-mail/mail/v2"
@@ -19,10 +21,20 @@ import (
 //go:embed "templates"
 var templatFS embed.FS
 
+// Emails sent and failed since startup, across every Mailer. Package level
+// since the mailer is replaced whenever the config is reloaded.
+var sent, failed atomic.Int64
+
+// Returns how many Send calls succeeded and failed so far.
+func Counts() (sentCount, failedCount int64) {
+	return sent.Load(), failed.Load()
+}
+
 // Dialer instance used to connect to a SMTP server and sender info for emails.
 type Mailer struct {
-	dialer *mail.Dialer
-	sender string
+	dialer  *mail.Dialer
+	sender  string
+	headers map[string]string
 }
 
 func New(host string, port int, username, password, sender string) Mailer {
@@ -35,9 +47,28 @@ func New(host string, port int, username, password, sender string) Mailer {
 	}
 }
 
+// Returns a copy of the mailer which adds these headers to every email, e.g.
+// the ID of the request that triggered it.
+func (m Mailer) WithHeaders(headers map[string]string) Mailer {
+	merged := make(map[string]string, len(m.headers)+len(headers))
+	maps.Copy(merged, m.headers)
+	maps.Copy(merged, headers)
+
+	m.headers = merged
+	return m
+}
+
 // Takes recipient email address, name of file containing the templates, and any
 // dynamic data for the templates as an any param.
-func (m Mailer) Send(recipient, templateFile string, data any) error {
+func (m Mailer) Send(recipient, templateFile string, data any) (err error) {
+	defer func() {
+		if err != nil {
+			failed.Add(1)
+		} else {
+			sent.Add(1)
+		}
+	}()
+
 	// Parse the required template file from embedded file system.
 	tmpl, err := template.New("email").ParseFS(templatFS, "templates/"+templateFile)
 	if err != nil {
@@ -71,6 +102,9 @@ func (m Mailer) Send(recipient, templateFile string, data any) error {
 	msg.SetHeader("To", recipient)
 	msg.SetHeader("From", m.sender)
 	msg.SetHeader("Subject", subject.String())
+	for name, value := range m.headers {
+		msg.SetHeader(name, value)
+	}
 	msg.SetBody("text/plain", plainBody.String())
 	msg.AddAlternative("text/html", htmlBody.String())
 
@@ -87,3 +121,14 @@ func (m Mailer) Send(recipient, templateFile string, data any) error {
 
 	return err
 }
+
+// Checks the SMTP server is reachable and accepts our credentials, without
+// sending anything.
+func (m Mailer) Ping() error {
+	conn, err := m.dialer.Dial()
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
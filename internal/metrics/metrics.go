@@ -0,0 +1,293 @@
+// Package metrics is a small Prometheus client: counters, histograms and
+// gauges read at scrape time, written out in the text exposition format.
+// Just enough for /metrics, so we don't need the full client library.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Prometheus' default buckets, in seconds. Fine for HTTP latencies.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// One value of a metric read at scrape time.
+type Sample struct {
+	Labels []string // Values, in the order of the metric's label names.
+	Value  float64
+}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+	names   map[string]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+func (r *Registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.names[name] {
+		panic("metrics: " + name + " registered twice")
+	}
+
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// Writes every metric in the text format.
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	metrics := r.metrics
+	r.mu.Unlock()
+
+	buf := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(buf)
+	}
+	buf.Flush()
+}
+
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+// Counter with labels, e.g. mail sends by result.
+type Counter struct {
+	name, help string
+	labelNames []string
+
+	mu     sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labels []string
+	value  float64
+}
+
+func (r *Registry) Counter(name, help string, labelNames ...string) *Counter {
+	c := &Counter{name: name, help: help, labelNames: labelNames, values: make(map[string]*counterValue)}
+	r.register(name, c)
+	return c
+}
+
+// Adds v to the counter for the given label values.
+func (c *Counter) Add(v float64, labels ...string) {
+	key := strings.Join(labels, "\xff")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cv, ok := c.values[key]
+	if !ok {
+		cv = &counterValue{labels: append([]string(nil), labels...)}
+		c.values[key] = cv
+	}
+	cv.value += v
+}
+
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	samples := make([]Sample, 0, len(c.values))
+	for _, cv := range c.values {
+		samples = append(samples, Sample{Labels: cv.labels, Value: cv.value})
+	}
+	c.mu.Unlock()
+
+	writeSamples(w, c.name, c.help, "counter", c.labelNames, samples)
+}
+
+type Histogram struct {
+	name, help string
+	labelNames []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64 // Per bucket, not cumulative.
+	sum    float64
+	count  uint64
+}
+
+func (r *Registry) Histogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	h := &Histogram{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		buckets:    buckets,
+		values:     make(map[string]*histogramValue),
+	}
+	r.register(name, h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labels ...string) {
+	key := strings.Join(labels, "\xff")
+	i := sort.SearchFloat64s(h.buckets, v)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{labels: append([]string(nil), labels...), counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+
+	if i < len(h.buckets) {
+		hv.counts[i]++
+	}
+	hv.sum += v
+	hv.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, escapeHelp(h.help), h.name)
+
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		hv := h.values[key]
+
+		// Capped so appending "le" never writes into the shared arrays.
+		leNames := append(h.labelNames[:len(h.labelNames):len(h.labelNames)], "le")
+		leValues := hv.labels[:len(hv.labels):len(hv.labels)]
+
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += hv.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+				formatLabels(leNames, append(leValues, formatFloat(upper))), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+			formatLabels(leNames, append(leValues, "+Inf")), hv.count)
+
+		labels := formatLabels(h.labelNames, hv.labels)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, hv.count)
+	}
+}
+
+// Metric whose samples are read from fn at scrape time, e.g. DB pool stats.
+// typ is "gauge" or "counter".
+type funcMetric struct {
+	name, help, typ string
+	labelNames      []string
+	fn              func() []Sample
+}
+
+func (r *Registry) Func(name, help, typ string, labelNames []string, fn func() []Sample) {
+	r.register(name, &funcMetric{name: name, help: help, typ: typ, labelNames: labelNames, fn: fn})
+}
+
+// Unlabelled gauge read at scrape time.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	r.Func(name, help, "gauge", nil, func() []Sample {
+		return []Sample{{Value: fn()}}
+	})
+}
+
+// Unlabelled counter read at scrape time. fn must never go down.
+func (r *Registry) CounterFunc(name, help string, fn func() float64) {
+	r.Func(name, help, "counter", nil, func() []Sample {
+		return []Sample{{Value: fn()}}
+	})
+}
+
+func (m *funcMetric) write(w io.Writer) {
+	writeSamples(w, m.name, m.help, m.typ, m.labelNames, m.fn())
+}
+
+func writeSamples(w io.Writer, name, help, typ string, labelNames []string, samples []Sample) {
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].Labels, "\xff") < strings.Join(samples[j].Labels, "\xff")
+	})
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(help), name, typ)
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(labelNames, s.Labels), formatFloat(s.Value))
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
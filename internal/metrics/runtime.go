@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"io"
+	"runtime"
+)
+
+// Go runtime metrics, named like the official client's so existing
+// dashboards work.
+type runtimeMetrics struct{}
+
+func (r *Registry) RegisterRuntime() {
+	r.register("go", runtimeMetrics{})
+}
+
+func (runtimeMetrics) write(w io.Writer) {
+	// One stop the world per scrape, not one per metric.
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	gauge := func(name, help string, v float64) {
+		writeSamples(w, name, help, "gauge", nil, []Sample{{Value: v}})
+	}
+	counter := func(name, help string, v float64) {
+		writeSamples(w, name, help, "counter", nil, []Sample{{Value: v}})
+	}
+
+	writeSamples(w, "go_info", "Information about the Go environment.", "gauge",
+		[]string{"version"}, []Sample{{Labels: []string{runtime.Version()}, Value: 1}})
+
+	gauge("go_goroutines", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine()))
+	gauge("go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", float64(ms.Alloc))
+	counter("go_memstats_alloc_bytes_total", "Total number of bytes allocated, even if freed.", float64(ms.TotalAlloc))
+	gauge("go_memstats_sys_bytes", "Number of bytes obtained from system.", float64(ms.Sys))
+	gauge("go_memstats_heap_alloc_bytes", "Number of heap bytes allocated and still in use.", float64(ms.HeapAlloc))
+	gauge("go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.", float64(ms.HeapInuse))
+	gauge("go_memstats_heap_idle_bytes", "Number of heap bytes waiting to be used.", float64(ms.HeapIdle))
+	gauge("go_memstats_heap_objects", "Number of allocated objects.", float64(ms.HeapObjects))
+	gauge("go_memstats_stack_inuse_bytes", "Number of bytes in use by the stack allocator.", float64(ms.StackInuse))
+	counter("go_memstats_mallocs_total", "Total number of mallocs.", float64(ms.Mallocs))
+	counter("go_memstats_frees_total", "Total number of frees.", float64(ms.Frees))
+	gauge("go_memstats_next_gc_bytes", "Number of heap bytes when next garbage collection will take place.", float64(ms.NextGC))
+	counter("go_gc_cycles_total", "Number of completed GC cycles.", float64(ms.NumGC))
+	counter("go_gc_pause_seconds_total", "Total time spent in GC stop the world pauses.", float64(ms.PauseTotalNs)/1e9)
+}
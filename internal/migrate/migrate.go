@@ -0,0 +1,335 @@
+package migrate
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"slices"
+	"strconv"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrDirty       = errors.New("database is in a dirty migration state")
+	ErrNoMigration = errors.New("no migration with that version")
+	ErrUnknown     = errors.New("database is at a version this binary doesn't know about")
+)
+
+// Key for pg_advisory_lock, so two instances never migrate at the same time.
+// Arbitrary, just needs to be stable.
+const lockKey = 7_342_118_004
+
+// Files are named like the migrate CLI creates them: 000001_create_movies_table.up.sql
+var filenameRX = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Applied state of a single migration, for `migrate status`.
+type Status struct {
+	Migration
+	Applied bool
+}
+
+// Applies embedded migrations. Tracks the current version in the same
+// schema_migrations table the migrate CLI uses, so existing databases carry on
+// where they left off.
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration // Sorted by version.
+}
+
+func New(db *sql.DB, fsys fs.FS) (*Migrator, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+
+	for _, entry := range entries {
+		match := filenameRX.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %w", entry.Name(), err)
+		}
+
+		sqlText, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has mismatched names %q and %q", version, m.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			m.Up = string(sqlText)
+		} else {
+			m.Down = string(sqlText)
+		}
+	}
+
+	mg := &Migrator{db: db}
+	for _, m := range byVersion {
+		mg.migrations = append(mg.migrations, *m)
+	}
+
+	slices.SortFunc(mg.migrations, func(a, b Migration) int {
+		return cmp.Compare(a.Version, b.Version)
+	})
+
+	return mg, nil
+}
+
+// The newest version this binary knows about, 0 if there are no migrations.
+func (mg *Migrator) Latest() int64 {
+	if len(mg.migrations) == 0 {
+		return 0
+	}
+	return mg.migrations[len(mg.migrations)-1].Version
+}
+
+// Current schema version, 0 if nothing has been applied yet. Read only, so
+// it works for a role that can't create tables, e.g. the app's at startup.
+func (mg *Migrator) Version(ctx context.Context) (int64, bool, error) {
+	return currentVersion(ctx, mg.db)
+}
+
+func (mg *Migrator) Status(ctx context.Context) ([]Status, error) {
+	version, _, err := mg.Version(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, len(mg.migrations))
+	for i, m := range mg.migrations {
+		statuses[i] = Status{Migration: m, Applied: m.Version <= version}
+	}
+
+	return statuses, nil
+}
+
+// Applies all pending up migrations. Returns the ones that ran.
+func (mg *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	return mg.Goto(ctx, mg.Latest())
+}
+
+// Rolls back the last n applied migrations.
+func (mg *Migrator) Down(ctx context.Context, n int) ([]Migration, error) {
+	var ran []Migration
+
+	err := mg.withLock(ctx, func(conn *sql.Conn) error {
+		version, err := mg.checkVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		if version == 0 {
+			return nil
+		}
+
+		i := mg.index(version)
+		target := int64(0)
+		if i-n >= 0 {
+			target = mg.migrations[i-n].Version
+		}
+
+		ran, err = mg.migrate(ctx, conn, version, target)
+		return err
+	})
+
+	return ran, err
+}
+
+// Migrates up or down to exactly the given version. 0 means roll everything back.
+func (mg *Migrator) Goto(ctx context.Context, target int64) ([]Migration, error) {
+	if target != 0 && mg.index(target) == -1 {
+		return nil, ErrNoMigration
+	}
+
+	var ran []Migration
+
+	err := mg.withLock(ctx, func(conn *sql.Conn) error {
+		version, err := mg.checkVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		ran, err = mg.migrate(ctx, conn, version, target)
+		return err
+	})
+
+	return ran, err
+}
+
+func (mg *Migrator) migrate(ctx context.Context, conn *sql.Conn, from, to int64) ([]Migration, error) {
+	var ran []Migration
+
+	// Going up, apply everything in (from, to].
+	for _, m := range mg.migrations {
+		if m.Version > from && m.Version <= to {
+			err := apply(ctx, conn, m.Up, m.Version)
+			if err != nil {
+				return ran, fmt.Errorf("migration %d_%s up: %w", m.Version, m.Name, err)
+			}
+			ran = append(ran, m)
+		}
+	}
+
+	// Going down, undo everything in (to, from], newest first. Each step lands
+	// on the previous migration's version.
+	for i := len(mg.migrations) - 1; i >= 0; i-- {
+		m := mg.migrations[i]
+		if m.Version <= from && m.Version > to {
+			prev := int64(0)
+			if i > 0 {
+				prev = mg.migrations[i-1].Version
+			}
+
+			err := apply(ctx, conn, m.Down, prev)
+			if err != nil {
+				return ran, fmt.Errorf("migration %d_%s down: %w", m.Version, m.Name, err)
+			}
+			ran = append(ran, m)
+		}
+	}
+
+	return ran, nil
+}
+
+// Runs a migration and records the new version in one transaction, so a failed
+// migration leaves nothing half applied.
+func apply(ctx context.Context, conn *sql.Conn, sqlText string, newVersion int64) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if sqlText != "" {
+		_, err = tx.ExecContext(ctx, sqlText)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+
+	if newVersion > 0 {
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES ($1, false)`, newVersion)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Holds a session level advisory lock for the duration of fn. Needs a
+// dedicated conn since the lock belongs to the session.
+func (mg *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := mg.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockKey)
+	if err != nil {
+		return err
+	}
+
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, lockKey)
+
+	err = ensureTable(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
+
+// Position of version in mg.migrations, -1 if unknown.
+func (mg *Migrator) index(version int64) int {
+	return slices.IndexFunc(mg.migrations, func(m Migration) bool {
+		return m.Version == version
+	})
+}
+
+type execQueryer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func ensureTable(ctx context.Context, db execQueryer) error {
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version bigint NOT NULL PRIMARY KEY,
+			dirty boolean NOT NULL
+		)
+	`)
+	return err
+}
+
+func currentVersion(ctx context.Context, db execQueryer) (int64, bool, error) {
+	var version int64
+	var dirty bool
+
+	err := db.QueryRowContext(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	if err != nil {
+		var pqErr *pq.Error
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, false, nil
+		// No table yet, nothing has ever been migrated.
+		case errors.As(err, &pqErr) && pqErr.Code == "42P01":
+			return 0, false, nil
+		default:
+			return 0, false, err
+		}
+	}
+
+	return version, dirty, nil
+}
+
+// Current version, refusing to go on if a previous (migrate CLI) run died
+// half way through, or if a newer binary already migrated past what we know.
+func (mg *Migrator) checkVersion(ctx context.Context, conn *sql.Conn) (int64, error) {
+	version, dirty, err := currentVersion(ctx, conn)
+	if err != nil {
+		return 0, err
+	}
+
+	if dirty {
+		return version, fmt.Errorf("%w at version %d, fix it by hand before migrating", ErrDirty, version)
+	}
+
+	if version != 0 && mg.index(version) == -1 {
+		return version, fmt.Errorf("%w (%d)", ErrUnknown, version)
+	}
+
+	return version, nil
+}
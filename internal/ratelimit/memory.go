@@ -0,0 +1,93 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Token buckets in process memory. Fast, but each instance has its own, and
+// they're gone on restart.
+type Memory struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{buckets: make(map[string]*bucket)}
+}
+
+func (m *Memory) Allow(_ context.Context, key string, limit Limit, cost int) (Result, error) {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, found := m.buckets[key]
+	if !found {
+		b = &bucket{limiter: rate.NewLimiter(rate.Limit(limit.Rate), limit.Burst)}
+		m.buckets[key] = b
+	}
+
+	// Bring existing buckets in line if the limit changed.
+	if b.limiter.Limit() != rate.Limit(limit.Rate) {
+		b.limiter.SetLimitAt(now, rate.Limit(limit.Rate))
+	}
+	if b.limiter.Burst() != limit.Burst {
+		b.limiter.SetBurstAt(now, limit.Burst)
+	}
+
+	b.lastSeen = now
+
+	allowed := b.limiter.AllowN(now, cost)
+	tokens := b.limiter.TokensAt(now)
+
+	result := Result{
+		Allowed:    allowed,
+		Remaining:  max(int(math.Floor(tokens)), 0),
+		ResetAfter: seconds((float64(limit.Burst) - tokens) / limit.Rate),
+	}
+
+	if !allowed {
+		result.RetryAfter = seconds((float64(cost) - tokens) / limit.Rate)
+	}
+
+	return result, nil
+}
+
+// Number of buckets, i.e. keys seen within the cleanup window.
+func (m *Memory) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.buckets)
+}
+
+// Drops buckets not used for maxAge, every interval until ctx is done.
+func (m *Memory) Cleanup(ctx context.Context, interval, maxAge time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.mu.Lock()
+			for key, b := range m.buckets {
+				if time.Since(b.lastSeen) > maxAge {
+					delete(m.buckets, key)
+				}
+			}
+			m.mu.Unlock()
+		}
+	}
+}
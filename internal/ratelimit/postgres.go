@@ -0,0 +1,110 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"time"
+)
+
+// GCRA (generic cell rate algorithm) on a Postgres table, so every instance
+// shares the same limits and they survive restarts. Each key is one row
+// holding its "theoretical arrival time" (tat): when the bucket would be full
+// again if nothing else came in. A request of cost n pushes tat forward by n
+// emission intervals, and is allowed as long as tat doesn't end up more than
+// a burst's worth of intervals ahead of now. Uses the database clock so
+// instances don't need synced clocks.
+type Postgres struct {
+	DB *sql.DB
+}
+
+func NewPostgres(db *sql.DB) *Postgres {
+	return &Postgres{DB: db}
+}
+
+func (p *Postgres) Allow(ctx context.Context, key string, limit Limit, cost int) (Result, error) {
+	interval := 1 / limit.Rate
+	increment := interval * float64(cost)
+	tolerance := interval * float64(limit.Burst)
+
+	// The upsert locks the row, so the check and the update are atomic even
+	// with many instances hitting the same key. When the request isn't
+	// allowed the WHERE fails and nothing comes back.
+	query := `
+		INSERT INTO rate_limits AS rl (key, tat)
+		VALUES ($1, now() + make_interval(secs => $2))
+		ON CONFLICT (key) DO UPDATE
+		SET tat = GREATEST(rl.tat, now()) + make_interval(secs => $2)
+		WHERE GREATEST(rl.tat, now()) + make_interval(secs => $2) - make_interval(secs => $3) <= now()
+		RETURNING EXTRACT(EPOCH FROM tat - now())
+	`
+
+	// Could never be allowed.
+	if cost > limit.Burst {
+		return Result{RetryAfter: seconds(increment)}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	var ahead float64
+
+	err := p.DB.QueryRowContext(ctx, query, key, increment, tolerance).Scan(&ahead)
+	if err == nil {
+		return Result{
+			Allowed:    true,
+			Remaining:  remaining(tolerance, ahead, interval),
+			ResetAfter: seconds(ahead),
+		}, nil
+	}
+
+	if !errors.Is(err, sql.ErrNoRows) {
+		return Result{}, err
+	}
+
+	// Denied. Work out for how long, this part doesn't need to be atomic.
+	query = `
+		SELECT EXTRACT(EPOCH FROM GREATEST(tat, now()) - now())
+		FROM rate_limits
+		WHERE key = $1
+	`
+
+	err = p.DB.QueryRowContext(ctx, query, key).Scan(&ahead)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return Result{}, err
+	}
+
+	return Result{
+		Remaining:  remaining(tolerance, ahead, interval),
+		ResetAfter: seconds(ahead),
+		RetryAfter: seconds(ahead + increment - tolerance),
+	}, nil
+}
+
+// Whole requests that still fit before tat is a full burst ahead.
+func remaining(tolerance, ahead, interval float64) int {
+	return max(int(math.Floor((tolerance-ahead)/interval+1e-9)), 0)
+}
+
+// Deletes rows for full buckets every interval until ctx is done. They'd act
+// the same as a missing row, so this only keeps the table small.
+func (p *Postgres) Cleanup(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deleteCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			_, err := p.DB.ExecContext(deleteCtx, `DELETE FROM rate_limits WHERE tat < now()`)
+			cancel()
+
+			if err != nil {
+				onError(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,40 @@
+// Package ratelimit has the limiter backends behind the rateLimit middleware:
+// an in-process token bucket, and a Postgres one shared by every instance.
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Requests per second, allowing bursts of up to Burst at once.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+type Result struct {
+	Allowed bool
+	// Requests left in the current burst.
+	Remaining int
+	// Until the bucket is full again.
+	ResetAfter time.Duration
+	// Until the request would have been allowed, 0 if it was.
+	RetryAfter time.Duration
+}
+
+type Limiter interface {
+	// Takes cost tokens from key's bucket if it has them. The limit is passed
+	// on every call, so it can change at runtime.
+	Allow(ctx context.Context, key string, limit Limit, cost int) (Result, error)
+}
+
+// Converts a number of seconds to a Duration, rounding up so clients waiting
+// for it don't come back a little too early.
+func seconds(s float64) time.Duration {
+	if s <= 0 {
+		return 0
+	}
+	d := time.Duration(s * float64(time.Second))
+	return d.Round(time.Millisecond) + time.Millisecond
+}
@@ -0,0 +1,252 @@
+package toml
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Bare keys and table names as TOML defines them. Dotted table names like
+// [db.replica] are allowed, dotted keys aren't.
+var (
+	keyRX    = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	tableRX  = regexp.MustCompile(`^\[\s*([A-Za-z0-9_-]+(?:\.[A-Za-z0-9_-]+)*)\s*\]$`)
+	numberRX = regexp.MustCompile(`^[+-]?[0-9](?:_?[0-9])*(?:\.[0-9](?:_?[0-9])*)?(?:[eE][+-]?[0-9](?:_?[0-9])*)?$`)
+)
+
+// A value from the file. Strings are unescaped, numbers have their
+// underscores removed and bools are "true" or "false", so scalars can go
+// straight to flag.Value.Set.
+type Value struct {
+	Scalar  string
+	Array   []string
+	IsArray bool
+}
+
+// Parses the subset of TOML we need for config files. Returns a flat map
+// keyed by "table.key". Supported:
+//
+//   - [tables], dotted ones included, with bare names
+//   - bare keys, not quoted or dotted ones
+//   - basic "strings" with TOML's escapes, and literal 'strings'
+//   - decimal integers and floats, underscores allowed between digits
+//   - true and false
+//   - single line arrays of the above, a trailing comma is fine
+//   - # comments, on their own line or after a value
+//
+// Anything else (multi-line strings and arrays, inline tables, arrays of
+// tables, dates, hex/octal/binary, inf and nan) is an error rather than
+// misread.
+func Parse(r io.Reader) (map[string]Value, error) {
+	values := make(map[string]Value)
+	table := ""
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Table names are bare, so the first # is where a comment starts.
+		if strings.HasPrefix(line, "[") {
+			header, _, _ := strings.Cut(line, "#")
+			match := tableRX.FindStringSubmatch(strings.TrimSpace(header))
+			if match == nil {
+				return nil, fmt.Errorf("line %d: invalid table header %q", lineNo, line)
+			}
+			table = match[1]
+			continue
+		}
+
+		// Same for keys and the =.
+		key, raw, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNo)
+		}
+
+		key = strings.TrimSpace(key)
+		if !keyRX.MatchString(key) {
+			return nil, fmt.Errorf("line %d: invalid key %q", lineNo, key)
+		}
+
+		if table != "" {
+			key = table + "." + key
+		}
+
+		if _, exists := values[key]; exists {
+			return nil, fmt.Errorf("line %d: duplicate key %q", lineNo, key)
+		}
+
+		value, rest, err := parseValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", lineNo, key, err)
+		}
+
+		rest = strings.TrimSpace(rest)
+		if rest != "" && !strings.HasPrefix(rest, "#") {
+			return nil, fmt.Errorf("line %d: %s: unexpected %q after value", lineNo, key, rest)
+		}
+
+		values[key] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+// Reads a value off the front of s. Returns what's left of the line after it.
+func parseValue(s string) (Value, string, error) {
+	if !strings.HasPrefix(s, "[") {
+		scalar, rest, err := parseScalar(s)
+		return Value{Scalar: scalar}, rest, err
+	}
+
+	items := []string{}
+	s = s[1:]
+
+	for {
+		s = strings.TrimSpace(s)
+
+		switch {
+		case s == "" || strings.HasPrefix(s, "#"):
+			return Value{}, "", fmt.Errorf("arrays must be on a single line")
+		case strings.HasPrefix(s, "]"):
+			return Value{Array: items, IsArray: true}, s[1:], nil
+		case strings.HasPrefix(s, "["):
+			return Value{}, "", fmt.Errorf("nested arrays aren't supported")
+		}
+
+		item, rest, err := parseScalar(s)
+		if err != nil {
+			return Value{}, "", err
+		}
+		items = append(items, item)
+
+		s = strings.TrimSpace(rest)
+		switch {
+		case strings.HasPrefix(s, ","):
+			s = s[1:]
+		case strings.HasPrefix(s, "]"):
+		case s == "" || strings.HasPrefix(s, "#"):
+			return Value{}, "", fmt.Errorf("arrays must be on a single line")
+		default:
+			return Value{}, "", fmt.Errorf("expected , or ] in array, got %q", s)
+		}
+	}
+}
+
+func parseScalar(s string) (string, string, error) {
+	switch {
+	case s == "" || strings.HasPrefix(s, "#"):
+		return "", "", fmt.Errorf("missing value")
+
+	case strings.HasPrefix(s, `"""`) || strings.HasPrefix(s, "'''"):
+		return "", "", fmt.Errorf("multi-line strings aren't supported")
+
+	case strings.HasPrefix(s, `"`):
+		return parseBasicString(s)
+
+	case strings.HasPrefix(s, "'"):
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated string %s", s)
+		}
+		return s[1 : end+1], s[end+2:], nil
+
+	case strings.HasPrefix(s, "{"):
+		return "", "", fmt.Errorf("inline tables aren't supported")
+	}
+
+	// Bools and numbers run up to whatever can follow a value.
+	end := strings.IndexAny(s, " \t,]#")
+	if end < 0 {
+		end = len(s)
+	}
+	token, rest := s[:end], s[end:]
+
+	switch {
+	case token == "true" || token == "false":
+		return token, rest, nil
+	case numberRX.MatchString(token):
+		return strings.ReplaceAll(token, "_", ""), rest, nil
+	}
+
+	return "", "", fmt.Errorf("unsupported value %s", token)
+}
+
+// TOML's escapes, which aren't Go's: no \a, \v, \x or octal, and \u and \U
+// must be valid Unicode scalar values.
+var escapes = map[byte]string{
+	'b':  "\b",
+	't':  "\t",
+	'n':  "\n",
+	'f':  "\f",
+	'r':  "\r",
+	'"':  `"`,
+	'\\': `\`,
+}
+
+// s starts with the opening quote.
+func parseBasicString(s string) (string, string, error) {
+	var b strings.Builder
+
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case c == '"':
+			return b.String(), s[i+1:], nil
+
+		case c == '\\':
+			if i+1 == len(s) {
+				return "", "", fmt.Errorf("unterminated string %s", s)
+			}
+			i++
+
+			if esc, ok := escapes[s[i]]; ok {
+				b.WriteString(esc)
+				continue
+			}
+
+			size := 0
+			switch s[i] {
+			case 'u':
+				size = 4
+			case 'U':
+				size = 8
+			default:
+				return "", "", fmt.Errorf("invalid escape \\%c in %s", s[i], s)
+			}
+
+			if i+size >= len(s) {
+				return "", "", fmt.Errorf("invalid escape in %s", s)
+			}
+			code, err := strconv.ParseUint(s[i+1:i+1+size], 16, 32)
+			if err != nil || !utf8.ValidRune(rune(code)) {
+				return "", "", fmt.Errorf("invalid escape \\%s in %s", s[i:i+1+size], s)
+			}
+			b.WriteRune(rune(code))
+			i += size
+
+		case c < 0x20 && c != '\t' || c == 0x7f:
+			return "", "", fmt.Errorf("control character in string %s", s)
+
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return "", "", fmt.Errorf("unterminated string %s", s)
+}
@@ -0,0 +1,141 @@
+package toml
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  map[string]Value
+	}{
+		{
+			name:  "tables and keys",
+			input: "port = 4000\n[db]\nmax_open_conns = 25\n[db.replica]\ndsn = 'x'\n",
+			want: map[string]Value{
+				"port":              {Scalar: "4000"},
+				"db.max_open_conns": {Scalar: "25"},
+				"db.replica.dsn":    {Scalar: "x"},
+			},
+		},
+		{
+			name:  "numbers and bools",
+			input: "a = 1_000\nb = -0.25\nc = 1e6\nd = true\ne = false\n",
+			want: map[string]Value{
+				"a": {Scalar: "1000"},
+				"b": {Scalar: "-0.25"},
+				"c": {Scalar: "1e6"},
+				"d": {Scalar: "true"},
+				"e": {Scalar: "false"},
+			},
+		},
+		{
+			name:  "basic string escapes",
+			input: `a = "tab\there \"quoted\" back\\slash \u00e9 \U0001F600"` + "\n",
+			want: map[string]Value{
+				"a": {Scalar: "tab\there \"quoted\" back\\slash \u00e9 \U0001F600"},
+			},
+		},
+		{
+			name:  "literal strings keep backslashes",
+			input: `a = 'C:\path\n'` + "\n" + `b = ''` + "\n",
+			want: map[string]Value{
+				"a": {Scalar: `C:\path\n`},
+				"b": {Scalar: ""},
+			},
+		},
+		{
+			name:  "comments",
+			input: "# top\n[db] # the db\ndsn = \"a#b\" # not part of it\nname = 'c#d'#tight\n  # indented\n",
+			want: map[string]Value{
+				"db.dsn":  {Scalar: "a#b"},
+				"db.name": {Scalar: "c#d"},
+			},
+		},
+		{
+			name:  "string ending in an escaped backslash",
+			input: `a = "x\\" # comment` + "\n",
+			want: map[string]Value{
+				"a": {Scalar: `x\`},
+			},
+		},
+		{
+			name:  "arrays keep items with spaces",
+			input: `a = ["one", 'two words', "three, four", 5, true,]` + "\n" + "b = []\n" + `c = [ "x" ] # done` + "\n",
+			want: map[string]Value{
+				"a": {Array: []string{"one", "two words", "three, four", "5", "true"}, IsArray: true},
+				"b": {Array: []string{}, IsArray: true},
+				"c": {Array: []string{"x"}, IsArray: true},
+			},
+		},
+		{
+			name:  "windows line endings",
+			input: "[tls]\r\nmin_version = \"1.3\"\r\n",
+			want: map[string]Value{
+				"tls.min_version": {Scalar: "1.3"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"bad table header", "[db\n", "line 1: invalid table header"},
+		{"array of tables", "[[db]]\n", "line 1: invalid table header"},
+		{"missing equals", "a = 1\nport\n", "line 2: expected key = value"},
+		{"quoted key", `"a b" = 1` + "\n", "line 1: invalid key"},
+		{"dotted key", "a.b = 1\n", "line 1: invalid key"},
+		{"duplicate key", "[db]\na = 1\n\na = 2\n", `line 4: duplicate key "db.a"`},
+		{"missing value", "a =\n", "line 1: a: missing value"},
+		{"go only escape", `a = "\x41"` + "\n", `line 1: a: invalid escape \x`},
+		{"bad unicode escape", `a = "\uD800"` + "\n", `line 1: a: invalid escape \uD800`},
+		{"short unicode escape", `a = "\u12"` + "\n", "line 1: a: invalid escape"},
+		{"unterminated string", `a = "abc` + "\n", "line 1: a: unterminated string"},
+		{"unterminated literal", "a = 'abc\n", "line 1: a: unterminated string"},
+		{"multi-line string", `a = """abc"""` + "\n", "line 1: a: multi-line strings aren't supported"},
+		{"multi-line literal", "a = '''abc'''\n", "line 1: a: multi-line strings aren't supported"},
+		{"multi-line array", "a = [\n  1,\n]\n", "line 1: a: arrays must be on a single line"},
+		{"nested array", "a = [[1], [2]]\n", "line 1: a: nested arrays aren't supported"},
+		{"missing comma", `a = ["x" "y"]` + "\n", "line 1: a: expected , or ] in array"},
+		{"inline table", "a = { b = 1 }\n", "line 1: a: inline tables aren't supported"},
+		{"bare word", "a = yes\n", "line 1: a: unsupported value yes"},
+		{"duration without quotes", "a = 5s\n", "line 1: a: unsupported value 5s"},
+		{"hex", "a = 0xff\n", "line 1: a: unsupported value 0xff"},
+		{"stray underscore", "a = 1__0\n", "line 1: a: unsupported value 1__0"},
+		{"text after value", `a = "x" y` + "\n", `line 1: a: unexpected "y" after value`},
+		{"two values", "a = 1 2\n", `line 1: a: unexpected "2" after value`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tt.input))
+			if err == nil {
+				t.Fatalf("expected an error containing %q", tt.want)
+			}
+
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// OTLP/JSON shapes, just the fields we fill in. IDs are hex and 64 bit ints
+// are strings, per the OTLP JSON mapping.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              Kind            `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"` // 2 is error, unset otherwise.
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+func otlpValue(v any) map[string]any {
+	switch v := v.(type) {
+	case string:
+		return map[string]any{"stringValue": v}
+	case bool:
+		return map[string]any{"boolValue": v}
+	case int:
+		return map[string]any{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]any{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]any{"doubleValue": v}
+	default:
+		return map[string]any{"stringValue": fmt.Sprint(v)}
+	}
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func encodeOTLP(service string, spans []*Span) []byte {
+	scope := otlpScopeSpans{}
+	scope.Scope.Name = "greenlight"
+
+	for _, s := range spans {
+		s.mu.Lock()
+		span := otlpSpan{
+			TraceID:           s.sc.TraceID.String(),
+			SpanID:            s.sc.SpanID.String(),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: unixNano(s.start),
+			EndTimeUnixNano:   unixNano(s.end),
+		}
+		for _, attr := range s.attrs {
+			span.Attributes = append(span.Attributes, otlpAttribute{attr.key, otlpValue(attr.value)})
+		}
+		if s.errMsg != "" {
+			span.Status = otlpStatus{Code: 2, Message: s.errMsg}
+		}
+		s.mu.Unlock()
+
+		if s.parent != (SpanID{}) {
+			span.ParentSpanID = s.parent.String()
+		}
+
+		scope.Spans = append(scope.Spans, span)
+	}
+
+	rs := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	rs.Resource.Attributes = []otlpAttribute{{"service.name", otlpValue(service)}}
+
+	// Nothing in there json can choke on.
+	js, _ := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{rs}})
+	return js
+}
+
+// Sends spans to an OTLP/HTTP collector, e.g. http://localhost:4318/v1/traces.
+type OTLPExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+	return &OTLPExporter{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (e *OTLPExporter) Export(ctx context.Context, batch []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(batch))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// Drain so the connection can be reused.
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("otlp export: %s", res.Status)
+	}
+
+	return nil
+}
+
+// Appends spans to a file, one OTLP/JSON request per line. The collector's
+// otlpjsonfile receiver reads this, as does jq.
+type FileExporter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileExporter(path string) (*FileExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileExporter{file: file}, nil
+}
+
+func (e *FileExporter) Export(_ context.Context, batch []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	_, err := e.file.Write(append(batch, '\n'))
+	return err
+}
+
+func (e *FileExporter) Close() error {
+	return e.file.Close()
+}
@@ -0,0 +1,162 @@
+package tracing
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	queueSize     = 2048
+	maxBatchSize  = 512
+	flushInterval = 5 * time.Second
+)
+
+// Where finished spans go. batch is an OTLP/JSON ExportTraceServiceRequest.
+type Exporter interface {
+	Export(ctx context.Context, batch []byte) error
+}
+
+type Tracer struct {
+	service    string
+	sampleRate float64
+	exporter   Exporter
+	onError    func(error)
+
+	queue   chan *Span
+	flush   chan chan struct{}
+	dropped atomic.Int64
+}
+
+// Starts a tracer exporting to exporter in the background. Traces we start
+// ourselves are sampled at sampleRate (0-1), ones coming in with a traceparent
+// follow the caller's decision. onError is told about failed exports.
+func New(service string, sampleRate float64, exporter Exporter, onError func(error)) *Tracer {
+	t := &Tracer{
+		service:    service,
+		sampleRate: sampleRate,
+		exporter:   exporter,
+		onError:    onError,
+		queue:      make(chan *Span, queueSize),
+		flush:      make(chan chan struct{}),
+	}
+
+	go t.run()
+
+	return t
+}
+
+// Starts the root span for an incoming req, as a child of remote if it's
+// valid, else in a new trace.
+func (t *Tracer) StartServer(ctx context.Context, name string, remote SpanContext) (context.Context, *Span) {
+	if !remote.IsValid() {
+		remote = SpanContext{Sampled: rand.Float64() < t.sampleRate}
+		newID(remote.TraceID[:])
+	}
+
+	span := t.newSpan(name, KindServer, remote)
+	return ContextWithSpan(ctx, span), span
+}
+
+// Child of parent, which may be remote. Unsampled spans still get IDs so the
+// trace carries on downstream.
+func (t *Tracer) newSpan(name string, kind Kind, parent SpanContext) *Span {
+	span := &Span{
+		tracer: t,
+		sc:     SpanContext{TraceID: parent.TraceID, Sampled: parent.Sampled},
+		parent: parent.SpanID,
+		kind:   kind,
+		start:  time.Now(),
+		name:   name,
+	}
+	newID(span.sc.SpanID[:])
+
+	return span
+}
+
+// Spans that didn't fit in the queue, because the exporter can't keep up.
+func (t *Tracer) Dropped() int64 {
+	return t.dropped.Load()
+}
+
+func (t *Tracer) enqueue(span *Span) {
+	select {
+	case t.queue <- span:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+func (t *Tracer) run() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		err := t.exporter.Export(ctx, encodeOTLP(t.service, batch))
+		if err != nil && t.onError != nil {
+			t.onError(err)
+		}
+
+		batch = nil
+	}
+
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) >= maxBatchSize {
+				export()
+			}
+
+		case <-ticker.C:
+			export()
+
+		case done := <-t.flush:
+			// Take whatever's queued right now, then stop. Spans ended
+			// after this just sit in the queue.
+			for len(t.queue) > 0 {
+				batch = append(batch, <-t.queue)
+				if len(batch) >= maxBatchSize {
+					export()
+				}
+			}
+			export()
+			close(done)
+			return
+		}
+	}
+}
+
+// Exports whatever's left and stops. Call once, after the last req is done.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+
+	select {
+	case t.flush <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if closer, ok := t.exporter.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,229 @@
+// Package tracing is a minimal OpenTelemetry style tracer. Spans go in the ctx,
+// so anything handed a ctx can start a child span without knowing about the
+// tracer, and finished spans are batched up and shipped off by an Exporter.
+// Trace context comes in and goes out as a W3C traceparent header.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TraceID [16]byte
+
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// Identifies a span, and through TraceID the trace it's part of.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// The traceparent header value for sc, e.g.
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// Parses a traceparent header. ok is false if it's missing or malformed, in
+// which case we start a new trace rather than fail the req.
+func ParseTraceparent(header string) (sc SpanContext, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 {
+		return SpanContext{}, false
+	}
+
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+
+	// Version ff is invalid. Version 00 has exactly four fields, later ones may
+	// add more, which we ignore.
+	if len(version) != 2 || version == "ff" || (version == "00" && len(parts) != 4) {
+		return SpanContext{}, false
+	}
+	if _, err := hex.DecodeString(version); err != nil {
+		return SpanContext{}, false
+	}
+
+	if !decodeHex(sc.TraceID[:], traceID) || !decodeHex(sc.SpanID[:], spanID) {
+		return SpanContext{}, false
+	}
+
+	var f [1]byte
+	if !decodeHex(f[:], flags) {
+		return SpanContext{}, false
+	}
+	sc.Sampled = f[0]&1 == 1
+
+	return sc, sc.IsValid()
+}
+
+// Lowercase only, as the spec says.
+func decodeHex(dst []byte, s string) bool {
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+type Kind int
+
+// Values match OTLP's SpanKind.
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+type attribute struct {
+	key   string
+	value any
+}
+
+// One timed operation. A nil Span, or one that isn't sampled, is a no-op, so
+// callers never have to check whether tracing is on.
+type Span struct {
+	tracer *Tracer
+	sc     SpanContext
+	parent SpanID
+	kind   Kind
+	start  time.Time
+
+	mu     sync.Mutex
+	name   string
+	end    time.Time
+	attrs  []attribute
+	errMsg string
+	ended  bool
+}
+
+func (s *Span) recording() bool {
+	return s != nil && s.tracer != nil && s.sc.Sampled
+}
+
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// For when the name is only known later, e.g. the route pattern.
+func (s *Span) SetName(name string) {
+	if !s.recording() {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.name = name
+}
+
+// value should be a string, bool, int, int64 or float64. Anything else is
+// recorded as its fmt.Sprint form.
+func (s *Span) SetAttribute(key string, value any) {
+	if !s.recording() {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, attribute{key, value})
+}
+
+// Marks the span failed. A nil err does nothing, so this can be called with
+// whatever the traced operation returned.
+func (s *Span) RecordError(err error) {
+	if err == nil || !s.recording() {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errMsg = err.Error()
+}
+
+// Finishes the span and queues it for export. Only the first call counts.
+func (s *Span) End() {
+	if !s.recording() {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	s.tracer.enqueue(s)
+}
+
+type contextKey string
+
+const spanContextKey = contextKey("span")
+
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanContextKey, span)
+}
+
+// The current span, nil if there's none.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey).(*Span)
+	return span
+}
+
+// Starts a child of the span in ctx. Without one, e.g. tracing is off or this
+// isn't running for a req, the span is a no-op.
+func Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+
+	span := parent.tracer.newSpan(name, kind, parent.sc)
+	return ContextWithSpan(ctx, span), span
+}
+
+// Trace ID of the span in ctx, "" if there's none. Handy for logs.
+func TraceIDFromContext(ctx context.Context) string {
+	sc := SpanFromContext(ctx).SpanContext()
+	if !sc.IsValid() {
+		return ""
+	}
+	return sc.TraceID.String()
+}
+
+// traceparent header value to send downstream, "" if there's no span.
+func Traceparent(ctx context.Context) string {
+	sc := SpanFromContext(ctx).SpanContext()
+	if !sc.IsValid() {
+		return ""
+	}
+	return sc.Traceparent()
+}
+
+func newID(b []byte) {
+	// Never fails on the platforms we run on.
+	_, _ = rand.Read(b)
+}
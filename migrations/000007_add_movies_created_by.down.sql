@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code IN ('movies:write:own', 'admin');
+DROP INDEX IF EXISTS movies_created_by_idx;
+ALTER TABLE movies DROP COLUMN IF EXISTS created_by;
@@ -0,0 +1,2 @@
+DELETE FROM permissions WHERE code = 'movies:approve';
+DROP TABLE IF EXISTS movie_submissions;
@@ -0,0 +1,27 @@
+CREATE TABLE IF NOT EXISTS movie_submissions (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    submitter_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    movie_id bigint REFERENCES movies ON DELETE CASCADE,
+    -- The movie's version when an edit was submitted, so approving it can't
+    -- undo changes made since. 0 for new movies.
+    movie_version integer NOT NULL DEFAULT 0,
+    title text NOT NULL,
+    year integer NOT NULL,
+    runtime integer NOT NULL,
+    genres text[] NOT NULL,
+    status text NOT NULL DEFAULT 'pending',
+    reviewer_id bigint REFERENCES users ON DELETE SET NULL,
+    comment text NOT NULL DEFAULT '',
+    reviewed_at timestamp(0) with time zone,
+    version integer NOT NULL DEFAULT 1
+);
+
+ALTER TABLE movie_submissions ADD CONSTRAINT movie_submissions_status_check
+    CHECK (status IN ('pending', 'approved', 'rejected'));
+
+CREATE INDEX IF NOT EXISTS movie_submissions_status_idx ON movie_submissions (status);
+
+INSERT INTO permissions (code)
+VALUES
+    ('movies:approve');
@@ -0,0 +1,9 @@
+-- Shared rate limiter state (see internal/ratelimit). tat is the GCRA
+-- "theoretical arrival time", once it's in the past the bucket is full and the
+-- row can go. Unlogged since losing it in a crash just resets everyone's limits.
+CREATE UNLOGGED TABLE IF NOT EXISTS rate_limits (
+    key text PRIMARY KEY,
+    tat timestamp with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS rate_limits_tat_idx ON rate_limits (tat);
@@ -0,0 +1,19 @@
+-- Recovered panics, one row per fingerprint (see newPanicError). The details
+-- are from the latest occurrence, count and first_seen cover all of them.
+-- user_id isn't a foreign key so reports outlive deleted users.
+CREATE TABLE IF NOT EXISTS crash_reports (
+    id bigserial PRIMARY KEY,
+    fingerprint text NOT NULL UNIQUE,
+    message text NOT NULL,
+    origin text NOT NULL,
+    stack text NOT NULL,
+    method text NOT NULL DEFAULT '',
+    route text NOT NULL DEFAULT '',
+    user_id bigint,
+    request_id text NOT NULL DEFAULT '',
+    count bigint NOT NULL DEFAULT 1,
+    first_seen timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    last_seen timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS crash_reports_last_seen_idx ON crash_reports (last_seen);
@@ -0,0 +1,8 @@
+// The SQL migrations, embedded so the api binary can apply them itself
+// (see `api migrate`) without shipping the files separately.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS
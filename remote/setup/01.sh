@@ -75,6 +75,9 @@ curl -1sLf 'https://dl.cloudsmith.io/public/caddy/stable/debian.deb.txt' | sudo
 apt update
 apt --yes install caddy
 
+# Let Caddy connect to the API's Unix socket (see api.socket).
+usermod -aG greenlight caddy
+
 # Upgrade all packages. Using the --force-confnew flag means that configuration
 # files will be replaced if newer ones are available.
 apt --yes -o Dpkg::Options::="--force-confnew" upgrade